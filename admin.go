@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAdminKey only lets requests carrying adminAPIKey as a bearer token
+// through to next. Admin endpoints are disabled when adminAPIKey is empty.
+func requireAdminKey(adminAPIKey string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAPIKey) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			writeResponse(w, http.StatusNotFound, StatusError, "admin API is not enabled")
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, StatusError, "invalid admin API key")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// handleAdminUpdate checks all databases for updates right away, and tells
+// whether any of them got updated. Recently fetched remote checksums are
+// reused, so that this can't be used for hammering MaxMind.
+func handleAdminUpdate(ctx context.Context, databases []*GeoIPDatabase, accountId int, licenseKey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		updated := false
+		for _, d := range databases {
+			var rateLimitErr *RateLimitError
+			databaseUpdated, err := d.RefreshDatabaseContext(ctx, accountId, licenseKey)
+			if errors.As(err, &rateLimitErr) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter.Seconds())))
+				writeResponse(w, http.StatusServiceUnavailable, StatusError, fmt.Sprintf("failed to update %s database: %s", d.edition(), err))
+				return
+			} else if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, fmt.Sprintf("failed to update %s database: %s", d.edition(), err))
+				return
+			}
+			updated = updated || databaseUpdated
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, struct {
+			Updated bool `json:"updated"`
+		}{
+			Updated: updated,
+		})
+	}
+}
+
+// handleAdminCache tells what the lookup cache holds for the IP given in the
+// ip query parameter, for confirming whether a stale answer comes from the
+// cache.
+func handleAdminCache(dbs *editionDatabases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		_, ip, ok := parseRequestIP(w, r, "", false)
+		if !ok {
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, db.CacheEntry(ip))
+	}
+}
+
+// handleAdminCacheStatsReset zeroes the hit and miss counters of the lookup
+// cache, so that the following /api/v1/cachestats requests measure a new
+// interval. Responds with the stats as of right before the reset.
+func handleAdminCacheStatsReset(dbs *editionDatabases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, db.CacheStats(true))
+	}
+}
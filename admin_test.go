@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminCacheStatsReset(t *testing.T) {
+	dbs := newTestEditions(t)
+	if _, err := dbs.defaultDatabase().GetRecord(net.ParseIP("1.2.3.4")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading the stats must not change them
+	var message string
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/cachestats?reset=true", nil)
+	serveTest(t, handleCacheStats(dbs), req, http.StatusBadRequest, &message)
+	serveTest(t, handleAdminCacheStatsReset(dbs), httptest.NewRequest(http.MethodGet, "/admin/cachestats/reset", nil), http.StatusMethodNotAllowed, &message)
+
+	var stats CacheStats
+	serveTest(t, handleAdminCacheStatsReset(dbs), httptest.NewRequest(http.MethodPost, "/admin/cachestats/reset", nil), http.StatusOK, &stats)
+	if *stats.Misses != 1 {
+		t.Errorf("expected the stats before the reset, got %d misses", *stats.Misses)
+	}
+
+	serveTest(t, handleCacheStats(dbs), httptest.NewRequest(http.MethodGet, "/api/v1/cachestats", nil), http.StatusOK, &stats)
+	if *stats.Hits != 0 || *stats.Misses != 0 {
+		t.Errorf("expected the counters to be reset, got %d hits and %d misses", *stats.Hits, *stats.Misses)
+	}
+}
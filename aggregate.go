@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type aggregateResult struct {
+	By         string          `json:"by"`
+	Counts     map[string]int  `json:"counts"`
+	Unknown    int             `json:"unknown"`
+	Errors     int             `json:"errors"`
+	ItemErrors []bulkItemError `json:"item_errors,omitempty"`
+}
+
+// handleAggregate resolves a batch of IPs and tallies them by country or
+// continent code, or by autonomous system number when asnDB is set. With
+// ?partial=true, IPs which can't be looked up are counted as errors and
+// listed along with why, instead of failing the whole request.
+func handleAggregate(dbs *editionDatabases, asnDB *GeoIPDatabase, strictJSON bool, lookupTimeout time.Duration, slots lookupSlots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		partial := r.URL.Query().Get("partial") == "true"
+		by := r.URL.Query().Get("by")
+		lookupDB := db
+		var groupKey func(record *GeoIPRecord) *string
+		switch by {
+		case "", "country":
+			by = "country"
+			groupKey = func(record *GeoIPRecord) *string { return record.Country.ISOCode }
+		case "continent":
+			groupKey = func(record *GeoIPRecord) *string { return record.Continent.Code }
+		case "asn":
+			if asnDB == nil {
+				writeResponse(w, http.StatusBadRequest, StatusError, "grouping by asn requires the ASN database, which is not enabled")
+				return
+			}
+			lookupDB = asnDB
+			groupKey = func(record *GeoIPRecord) *string {
+				if record.AutonomousSystemNumber == nil {
+					return nil
+				}
+				asn := strconv.FormatUint(uint64(*record.AutonomousSystemNumber), 10)
+				return &asn
+			}
+		default:
+			writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("unknown grouping %q", by))
+			return
+		}
+
+		var aggregateRequest struct {
+			IPs []string `json:"ips"`
+		}
+		if !decodeBulkRequest(w, r, strictJSON, &aggregateRequest) {
+			return
+		}
+		metricBulkRequestSize.WithLabelValues("aggregate").Observe(float64(len(aggregateRequest.IPs)))
+		ips, parseErrs, ok := parseBulkIPs(w, aggregateRequest.IPs, partial)
+		if !ok {
+			return
+		}
+
+		result := aggregateResult{
+			By:     by,
+			Counts: make(map[string]int),
+		}
+		records, errs := lookupBulk(r.Context(), lookupDB, ips, lookupTimeout, slots)
+		for i := range ips {
+			record, err := records[i], errs[i]
+			if parseErrs[i] != nil {
+				err = parseErrs[i]
+			}
+			if partial && (parseErrs[i] != nil || errors.Is(err, ErrorLookupTimeout) || errors.Is(err, ErrorIPv6NotSupported)) {
+				result.Errors++
+				result.ItemErrors = append(result.ItemErrors, bulkItemError{
+					Index: i,
+					IP:    aggregateRequest.IPs[i],
+					Error: err.Error(),
+				})
+				continue
+			} else if errors.Is(err, ErrorLookupTimeout) {
+				result.Errors++
+				continue
+			} else if errors.Is(err, ErrorIPv6NotSupported) {
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("%s (ip at index %d)", err, i))
+				return
+			} else if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+				return
+			}
+
+			if key := groupKey(record); key != nil {
+				result.Counts[*key]++
+			} else {
+				result.Unknown++
+			}
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, result)
+	}
+}
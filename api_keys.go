@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// parseAPIKeys parses a comma separated list of API keys
+func parseAPIKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// requestAPIKey returns the API key of the request, given either as a
+// bearer token or in the X-API-Key header
+func requestAPIKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// validAPIKey tells whether key is one of keys. All keys are always compared
+// in constant time, so the timing doesn't tell which one (if any) matched.
+func validAPIKey(key string, keys []string) bool {
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return len(key) > 0 && valid == 1
+}
+
+// requireAPIKey only lets requests to the /api/v1/ endpoints through when
+// they carry one of keys. Other endpoints (health checks and metrics) are
+// left alone, and nothing is required when there are no keys.
+func requireAPIKey(keys []string, next http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/v1/") && !validAPIKey(requestAPIKey(r), keys) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeResponse(w, http.StatusUnauthorized, StatusError, "invalid API key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
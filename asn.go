@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// asnNetworksFlushEvery is how many networks are written between flushes
+// when streaming /api/v1/asn/{number}/networks
+const asnNetworksFlushEvery = 1024
+
+type resolvedASN struct {
+	IP                           string  `json:"ip"`
+	AutonomousSystemNumber       *uint   `json:"autonomous_system_number"`
+	AutonomousSystemOrganization *string `json:"autonomous_system_organization"`
+}
+
+// handleASN resolves a single IP into its autonomous system. asnDB is nil
+// when the ASN database is not enabled.
+func handleASN(asnDB *GeoIPDatabase, ipJSONPath string, strictJSON bool, responseCacheControl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+		if asnDB == nil {
+			writeResponse(w, http.StatusNotFound, StatusError, "ASN database is not enabled")
+			return
+		}
+
+		_, ip, ok := parseRequestIP(w, r, ipJSONPath, strictJSON)
+		if !ok {
+			return
+		}
+
+		record, err := asnDB.GetRecord(ip)
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		if len(responseCacheControl) > 0 {
+			w.Header().Set("Cache-Control", responseCacheControl)
+		}
+		writeResponse(w, http.StatusOK, StatusOK, resolvedASN{
+			IP:                           ip.String(),
+			AutonomousSystemNumber:       record.AutonomousSystemNumber,
+			AutonomousSystemOrganization: record.AutonomousSystemOrganization,
+		})
+	}
+}
+
+// handleASNNetworks lists the networks of the autonomous system given in the
+// path, as AS15169 or 15169. The database is walked before anything is sent,
+// so that a slow client can't hold up database updates, and the networks are
+// then streamed out. asnDB is nil when the ASN database is not enabled.
+func handleASNNetworks(asnDB *GeoIPDatabase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+		if asnDB == nil {
+			writeResponse(w, http.StatusNotFound, StatusError, "ASN database is not enabled")
+			return
+		}
+
+		number := r.PathValue("number")
+		if len(number) > 2 && strings.EqualFold(number[:2], "AS") {
+			number = number[2:]
+		}
+		asn, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse asn")
+			return
+		}
+
+		prefixes, truncated, err := asnDB.NetworksOfASN(uint(asn))
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		// Same as writeResponse would send, without building it all up front
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, `{"status":"ok","data":{"asn":%d,"truncated":%t,"networks":[`, asn, truncated)
+		flusher, _ := w.(http.Flusher)
+		for i, prefix := range prefixes {
+			if i > 0 {
+				_, _ = w.Write([]byte(","))
+				if flusher != nil && i%asnNetworksFlushEvery == 0 {
+					flusher.Flush()
+				}
+			}
+			_, _ = fmt.Fprintf(w, `"%s"`, prefix)
+		}
+		_, _ = w.Write([]byte("]}}\n"))
+	}
+}
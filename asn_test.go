@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestASNNetworks(t *testing.T) {
+	asnDB := newTestEditionDatabase(t, ASNDBEdition, testASNDatabaseNetworks)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/asn/{number}/networks", handleASNNetworks(asnDB))
+
+	type asnNetworks struct {
+		ASN       uint     `json:"asn"`
+		Truncated bool     `json:"truncated"`
+		Networks  []string `json:"networks"`
+	}
+
+	for _, number := range []string{"15169", "AS15169", "as15169"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/asn/"+number+"/networks", nil)
+		var result asnNetworks
+		serveTest(t, mux, req, http.StatusOK, &result)
+
+		slices.Sort(result.Networks)
+		want := []string{"2001:4860::/32", "2a00:1450:4000::/37", "8.8.4.0/24", "8.8.8.0/24"}
+		if result.ASN != 15169 || result.Truncated || !slices.Equal(result.Networks, want) {
+			t.Errorf("expected networks %v of AS15169 for %s, got %+v", want, number, result)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/asn/64512/networks", nil)
+	var result asnNetworks
+	serveTest(t, mux, req, http.StatusOK, &result)
+	if result.Networks == nil || len(result.Networks) != 0 {
+		t.Errorf("expected no networks for an unknown ASN, got %+v", result)
+	}
+
+	asnDB.MaxIterationNetworks = 1
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/asn/15169/networks", nil)
+	serveTest(t, mux, req, http.StatusOK, &result)
+	if !result.Truncated || len(result.Networks) > 1 {
+		t.Errorf("expected a truncated result, got %+v", result)
+	}
+
+	var message string
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/asn/ASX/networks", nil)
+	serveTest(t, mux, req, http.StatusBadRequest, &message)
+}
+
+func TestASNNetworksDisabled(t *testing.T) {
+	var message string
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/asn/15169/networks", nil)
+	serveTest(t, handleASNNetworks(nil), req, http.StatusNotFound, &message)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxBulkRequestSize = 1 << 20
+	maxBulkIPs         = 10000
+)
+
+// decodeBulkRequest decodes a bulk request body into v. On failure an error
+// response is written and false is returned.
+func decodeBulkRequest(w http.ResponseWriter, r *http.Request, strictJSON bool, v interface{}) bool {
+	body := http.MaxBytesReader(w, r.Body, maxBulkRequestSize)
+	decoder := json.NewDecoder(body)
+	if strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+		return false
+	}
+	return true
+}
+
+// bulkItemError describes a single failed item of a bulk request made with
+// ?partial=true
+type bulkItemError struct {
+	Index int    `json:"index"`
+	IP    string `json:"ip"`
+	Error string `json:"error"`
+}
+
+// parseBulkIPs parses all IPs of a bulk request before any lookups are done.
+// Normally the first invalid IP fails the whole request, with partial set
+// its error is returned in errs (at the same index) and its IP is left nil.
+// On failure an error response is written and false is returned.
+func parseBulkIPs(w http.ResponseWriter, rawIPs []string, partial bool) ([]net.IP, []error, bool) {
+	if len(rawIPs) > maxBulkIPs {
+		writeResponse(w, http.StatusRequestEntityTooLarge, StatusError, fmt.Sprintf("too many ips, at most %d are allowed", maxBulkIPs))
+		return nil, nil, false
+	}
+
+	ips := make([]net.IP, len(rawIPs))
+	errs := make([]error, len(rawIPs))
+	for i, rawIP := range rawIPs {
+		if len(strings.TrimSpace(rawIP)) == 0 {
+			errs[i] = errors.New("empty ip")
+		} else if ips[i] = net.ParseIP(rawIP); ips[i] == nil {
+			errs[i] = errors.New("failed to parse ip")
+		}
+		if errs[i] != nil && !partial {
+			writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("%s at index %d", errs[i], i))
+			return nil, nil, false
+		}
+	}
+	return ips, errs, true
+}
+
+// lookupWithTimeout bounds a single lookup by timeout, if there is one
+func lookupWithTimeout(ctx context.Context, db *GeoIPDatabase, ip net.IP, timeout time.Duration) (*GeoIPRecord, error) {
+	if timeout <= 0 {
+		return db.GetRecord(ip)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return db.GetRecordContext(ctx, ip)
+}
+
+// lookupSlots bounds how many bulk requests look up their IPs at once,
+// process-wide. A nil lookupSlots doesn't bound anything.
+type lookupSlots chan struct{}
+
+// newLookupSlots creates lookupSlots for n requests at once, or none if n is
+// not positive
+func newLookupSlots(n int) lookupSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(lookupSlots, n)
+}
+
+// lookupBulk looks up all IPs one by one, once there's a free slot. Records
+// and errors are returned in the same order as the IPs. Nil IPs (which failed
+// to parse) are skipped, leaving both nil. If ctx is done before a slot frees
+// up, every lookup fails with ErrorLookupTimeout.
+//
+// Spreading the lookups over goroutines doesn't pay off: every lookup takes
+// the cache's exclusive lock (ARC moves entries around even on hits), so they
+// would mostly wait for each other.
+func lookupBulk(ctx context.Context, db *GeoIPDatabase, ips []net.IP, timeout time.Duration, slots lookupSlots) ([]*GeoIPRecord, []error) {
+	records := make([]*GeoIPRecord, len(ips))
+	errs := make([]error, len(ips))
+
+	// Waiting requests get their turns in the order they started waiting
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			for i, ip := range ips {
+				if ip != nil {
+					errs[i] = ErrorLookupTimeout
+				}
+			}
+			return records, errs
+		}
+	}
+
+	for i, ip := range ips {
+		if ip != nil {
+			records[i], errs[i] = lookupWithTimeout(ctx, db, ip, timeout)
+		}
+	}
+	return records, errs
+}
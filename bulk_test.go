@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// BenchmarkLookupBulk resolves 10k distinct IPs, more than fit the cache, so
+// that most lookups hit the database
+func BenchmarkLookupBulk(b *testing.B) {
+	db := newTestDatabase(b)
+	ips := make([]net.IP, 10000)
+	for i := range ips {
+		ips[i] = net.IPv4(1, 2, byte(i>>8), byte(i))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, errs := lookupBulk(context.Background(), db, ips, 0, nil)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestLookupBulkSlots(t *testing.T) {
+	db := newTestDatabase(t)
+	ips := []net.IP{net.ParseIP("1.2.3.4"), nil}
+	slots := newLookupSlots(1)
+
+	// Another request is looking up
+	slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	records, errs := lookupBulk(ctx, db, ips, 0, slots)
+	if !errors.Is(errs[0], ErrorLookupTimeout) || records[0] != nil {
+		t.Errorf("expected the lookup to time out waiting, got %v", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("expected the unparsed IP to be skipped, got %v", errs[1])
+	}
+
+	<-slots
+	records, errs = lookupBulk(context.Background(), db, ips, 0, slots)
+	if errs[0] != nil || records[0].Country.ISOCode == nil || *records[0].Country.ISOCode != "DE" {
+		t.Errorf("expected DE, got %+v, %v", records[0], errs[0])
+	}
+	if len(slots) != 0 {
+		t.Error("expected the slot to be given back")
+	}
+}
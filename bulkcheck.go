@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type bulkCheckResult struct {
+	IP      string `json:"ip"`
+	Allowed bool   `json:"allowed"`
+	Network string `json:"network,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	bulkCheckCSVHeader            = []string{"ip", "allowed", "error"}
+	bulkCheckCSVHeaderWithNetwork = []string{"ip", "allowed", "network", "error"}
+)
+
+func (r bulkCheckResult) csvRow(includeNetwork bool) []string {
+	if includeNetwork {
+		return []string{r.IP, strconv.FormatBool(r.Allowed), r.Network, r.Error}
+	}
+	return []string{r.IP, strconv.FormatBool(r.Allowed), r.Error}
+}
+
+// handleBulkCheck tells for every given IP whether it resolves to one of
+// the given countries. With ?partial=true, IPs which can't be checked get
+// an error of their own instead of failing the whole request.
+func handleBulkCheck(dbs *editionDatabases, strictJSON bool, lookupTimeout time.Duration, slots lookupSlots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		partial := r.URL.Query().Get("partial") == "true"
+		includeNetwork := r.URL.Query().Get("include_network") == "true"
+		asMap := false
+		switch as := r.URL.Query().Get("as"); as {
+		case "", "array":
+		case "map":
+			asMap = true
+		default:
+			writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("unknown response format %q", as))
+			return
+		}
+
+		var checkRequest struct {
+			IPs       []string `json:"ips"`
+			Countries []string `json:"countries"`
+		}
+		if !decodeBulkRequest(w, r, strictJSON, &checkRequest) {
+			return
+		}
+		metricBulkRequestSize.WithLabelValues("bulkcheck").Observe(float64(len(checkRequest.IPs)))
+		ips, parseErrs, ok := parseBulkIPs(w, checkRequest.IPs, partial)
+		if !ok {
+			return
+		}
+
+		countries := make(map[string]struct{}, len(checkRequest.Countries))
+		for _, country := range checkRequest.Countries {
+			countries[strings.ToUpper(strings.TrimSpace(country))] = struct{}{}
+		}
+
+		records, errs := lookupBulk(r.Context(), db, ips, lookupTimeout, slots)
+		results := make([]bulkCheckResult, len(ips))
+		for i, ip := range ips {
+			record, err := records[i], errs[i]
+			if parseErrs[i] != nil {
+				// Only with partial, the IP is echoed back as given
+				results[i] = bulkCheckResult{
+					IP:    checkRequest.IPs[i],
+					Error: parseErrs[i].Error(),
+				}
+				continue
+			} else if errors.Is(err, ErrorLookupTimeout) || (partial && errors.Is(err, ErrorIPv6NotSupported)) {
+				results[i] = bulkCheckResult{
+					IP:    ip.String(),
+					Error: err.Error(),
+				}
+				continue
+			} else if errors.Is(err, ErrorIPv6NotSupported) {
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("%s (ip at index %d)", err, i))
+				return
+			} else if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+				return
+			}
+
+			allowed := false
+			if record.Country.ISOCode != nil {
+				_, allowed = countries[*record.Country.ISOCode]
+			}
+			results[i] = bulkCheckResult{
+				IP:      ip.String(),
+				Allowed: allowed,
+			}
+			if includeNetwork {
+				results[i].Network = db.RecordNetwork(ip, record).String()
+			}
+		}
+
+		// CSV rows are always in the order of the request
+		csvHeader := bulkCheckCSVHeader
+		if includeNetwork {
+			csvHeader = bulkCheckCSVHeaderWithNetwork
+		}
+		rows := make([][]string, len(results))
+		for i, result := range results {
+			rows[i] = result.csvRow(includeNetwork)
+		}
+
+		if asMap {
+			// Keyed by the IPs as given, duplicates simply resolve to the same result
+			mapped := make(map[string]bulkCheckResult, len(results))
+			for i, result := range results {
+				mapped[checkRequest.IPs[i]] = result
+			}
+			writeNegotiatedResponse(w, r, http.StatusOK, mapped, csvHeader, rows)
+			return
+		}
+
+		writeNegotiatedResponse(w, r, http.StatusOK, results, csvHeader, rows)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBulkCheckIncludeNetwork(t *testing.T) {
+	dbs := newTestEditions(t)
+	handler := handleBulkCheck(dbs, false, 0, nil)
+	body := `{"ips":["1.2.3.4","2a00:1450:4001::1"],"countries":["DE"]}`
+
+	var results []bulkCheckResult
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/bulkcheck?include_network=true", strings.NewReader(body))
+	serveTest(t, handler, req, http.StatusOK, &results)
+	if len(results) != 2 || results[0].Network != "1.2.3.0/24" || results[1].Network != "2a00:1450::/32" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	// A lookup prefix longer than the database network doesn't narrow it
+	dbs.defaultDatabase().IPv6LookupPrefix = 48
+	results = nil
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/bulkcheck?include_network=true", strings.NewReader(body))
+	serveTest(t, handler, req, http.StatusOK, &results)
+	if len(results) != 2 || results[1].Network != "2a00:1450::/32" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	results = nil
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/bulkcheck", strings.NewReader(body))
+	serveTest(t, handler, req, http.StatusOK, &results)
+	if len(results) != 2 || results[0].Network != "" {
+		t.Errorf("expected no networks without include_network, got %+v", results)
+	}
+}
+
+func TestRecordNetworkLookupPrefix(t *testing.T) {
+	db := newTestDatabase(t)
+	db.IPv6LookupPrefix = 16
+	record := &GeoIPRecord{PrefixLength: 32}
+	if network := db.RecordNetwork(net.ParseIP("2a00:1450:4001::1"), record).String(); network != "2a00::/16" {
+		t.Errorf("expected the truncated network as it's larger, got %s", network)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBulkQueryIPs bounds how many IPs can be given in the query string,
+// which has to fit into a URL
+const maxBulkQueryIPs = 100
+
+type bulkCountryResult struct {
+	IP      string  `json:"ip"`
+	Country *string `json:"country"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// handleBulkCountry resolves a batch of IPs into their countries. The IPs
+// are either POSTed like for the other bulk endpoints, or given as a comma
+// separated ips query parameter with GET for quick manual lookups.
+func handleBulkCountry(dbs *editionDatabases, strictJSON bool, lookupTimeout time.Duration, slots lookupSlots) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		partial := r.URL.Query().Get("partial") == "true"
+		var rawIPs []string
+		if r.Method == http.MethodGet {
+			query := r.URL.Query().Get("ips")
+			if len(query) == 0 {
+				writeResponse(w, http.StatusBadRequest, StatusError, "missing ips")
+				return
+			}
+			rawIPs = strings.Split(query, ",")
+			if len(rawIPs) > maxBulkQueryIPs {
+				writeResponse(w, http.StatusRequestEntityTooLarge, StatusError, fmt.Sprintf("too many ips, at most %d are allowed in the query, POST more", maxBulkQueryIPs))
+				return
+			}
+			for i := range rawIPs {
+				rawIPs[i] = strings.TrimSpace(rawIPs[i])
+			}
+		} else {
+			var countryRequest struct {
+				IPs []string `json:"ips"`
+			}
+			if !decodeBulkRequest(w, r, strictJSON, &countryRequest) {
+				return
+			}
+			rawIPs = countryRequest.IPs
+		}
+		metricBulkRequestSize.WithLabelValues("bulkcountry").Observe(float64(len(rawIPs)))
+		ips, parseErrs, ok := parseBulkIPs(w, rawIPs, partial)
+		if !ok {
+			return
+		}
+
+		records, errs := lookupBulk(r.Context(), db, ips, lookupTimeout, slots)
+		results := make([]bulkCountryResult, len(ips))
+		for i, ip := range ips {
+			record, err := records[i], errs[i]
+			if parseErrs[i] != nil {
+				// Only with partial, the IP is echoed back as given
+				results[i] = bulkCountryResult{
+					IP:    rawIPs[i],
+					Error: parseErrs[i].Error(),
+				}
+				continue
+			} else if errors.Is(err, ErrorLookupTimeout) || (partial && errors.Is(err, ErrorIPv6NotSupported)) {
+				results[i] = bulkCountryResult{
+					IP:    ip.String(),
+					Error: err.Error(),
+				}
+				continue
+			} else if errors.Is(err, ErrorIPv6NotSupported) {
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("%s (ip at index %d)", err, i))
+				return
+			} else if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+				return
+			}
+
+			results[i] = bulkCountryResult{
+				IP:      ip.String(),
+				Country: record.Country.ISOCode,
+			}
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, results)
+	}
+}
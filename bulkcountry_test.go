@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBulkCountryQuery(t *testing.T) {
+	handler := handleBulkCountry(newTestEditions(t), false, 0, nil)
+
+	var results []bulkCountryResult
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/bulkcountry?ips=1.2.3.4,%208.8.8.8,10.0.0.1", nil)
+	serveTest(t, handler, req, http.StatusOK, &results)
+	if len(results) != 3 || *results[0].Country != "DE" || *results[1].Country != "US" || results[2].Country != nil {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	// Same results as POSTing the IPs
+	var posted []bulkCountryResult
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/bulkcountry", strings.NewReader(`{"ips":["1.2.3.4","8.8.8.8","10.0.0.1"]}`))
+	serveTest(t, handler, req, http.StatusOK, &posted)
+	if len(posted) != 3 || posted[1].IP != results[1].IP || *posted[1].Country != *results[1].Country {
+		t.Errorf("unexpected results %+v", posted)
+	}
+
+	var message string
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/bulkcountry?ips=1.2.3.4,nope", nil)
+	serveTest(t, handler, req, http.StatusBadRequest, &message)
+	if message != "failed to parse ip at index 1" {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/bulkcountry?ips=1.2.3.4,nope&partial=true", nil)
+	serveTest(t, handler, req, http.StatusOK, &results)
+	if len(results) != 2 || results[1].IP != "nope" || results[1].Error != "failed to parse ip" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	tooMany := strings.TrimSuffix(strings.Repeat("1.2.3.4,", maxBulkQueryIPs+1), ",")
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/bulkcountry?ips="+tooMany, nil)
+	serveTest(t, handler, req, http.StatusRequestEntityTooLarge, &message)
+}
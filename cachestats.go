@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handleCacheStats tells how well the lookup cache is doing. Resetting the
+// counters changes state, so it's left to handleAdminCacheStatsReset.
+func handleCacheStats(dbs *editionDatabases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if r.URL.Query().Has("reset") {
+			writeResponse(w, http.StatusBadRequest, StatusError, "resetting moved to POST /admin/cachestats/reset")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, db.CacheStats(false))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+type resolvedSubdivision struct {
+	ISOCode *string           `json:"iso_code"`
+	Names   map[string]string `json:"names,omitempty"`
+}
+
+type resolvedCity struct {
+	IP             string                `json:"ip"`
+	Country        *string               `json:"country"`
+	Continent      *string               `json:"continent,omitempty"`
+	City           *string               `json:"city,omitempty"`
+	CountryNames   map[string]string     `json:"country_names,omitempty"`
+	CityNames      map[string]string     `json:"city_names,omitempty"`
+	Subdivisions   []resolvedSubdivision `json:"subdivisions,omitempty"`
+	PostalCode     *string               `json:"postal_code,omitempty"`
+	Latitude       *coordinate           `json:"latitude,omitempty"`
+	Longitude      *coordinate           `json:"longitude,omitempty"`
+	AccuracyRadius *uint32               `json:"accuracy_radius,omitempty"`
+	TimeZone       *string               `json:"time_zone,omitempty"`
+}
+
+// handleCity resolves a single IP into everything the loaded database knows
+// about its location. City level fields are left out for Country databases.
+func handleCity(dbs *editionDatabases, ipJSONPath string, strictJSON bool, responseCacheControl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		_, ip, ok := parseRequestIP(w, r, ipJSONPath, strictJSON)
+		if !ok {
+			return
+		}
+		accuracyUnit, ok := accuracyRadiusUnit(w, r)
+		if !ok {
+			return
+		}
+
+		record, err := db.GetRecord(ip)
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		coordsAsString := r.URL.Query().Get("coords_as_string") == "true"
+		resolved := resolvedCity{
+			IP:             ip.String(),
+			Country:        record.Country.ISOCode,
+			Continent:      record.Continent.Code,
+			PostalCode:     record.Postal.Code,
+			Latitude:       newCoordinate(record.Location.Latitude, coordsAsString),
+			Longitude:      newCoordinate(record.Location.Longitude, coordsAsString),
+			AccuracyRadius: newAccuracyRadius(record.Location.AccuracyRadius, accuracyUnit),
+			TimeZone:       record.Location.TimeZone,
+		}
+		langs := requestLangs(r)
+		if name, ok := preferredName(record.City.Names, langs); ok {
+			resolved.City = &name
+		}
+		if len(langs) > 0 {
+			resolved.CountryNames = localizedNames(record.Country.Names, langs)
+			if len(record.City.Names) > 0 {
+				resolved.CityNames = localizedNames(record.City.Names, langs)
+			}
+		}
+		for _, subdivision := range record.Subdivisions {
+			names := subdivision.Names
+			if len(langs) > 0 {
+				names = localizedNames(names, langs)
+			}
+			resolved.Subdivisions = append(resolved.Subdivisions, resolvedSubdivision{
+				ISOCode: subdivision.ISOCode,
+				Names:   names,
+			})
+		}
+
+		if len(responseCacheControl) > 0 {
+			w.Header().Set("Cache-Control", responseCacheControl)
+		}
+		writeResponse(w, http.StatusOK, StatusOK, resolved)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCityCoordsAsString(t *testing.T) {
+	handler := handleCity(newTestCityEditions(t), "", false, "")
+
+	var numbers struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/city?ip=195.50.209.246&edition=GeoLite2-City", nil)
+	serveTest(t, handler, req, http.StatusOK, &numbers)
+	if numbers.Latitude != 59.437 || numbers.Longitude != 24.7535 {
+		t.Errorf("unexpected coordinates %+v", numbers)
+	}
+
+	var formatted struct {
+		Latitude  string `json:"latitude"`
+		Longitude string `json:"longitude"`
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/city?ip=195.50.209.246&edition=GeoLite2-City&coords_as_string=true", nil)
+	serveTest(t, handler, req, http.StatusOK, &formatted)
+	if formatted.Latitude != "59.4370" || formatted.Longitude != "24.7535" {
+		t.Errorf("unexpected coordinates %+v", formatted)
+	}
+}
+
+func TestCityAccuracyUnit(t *testing.T) {
+	handler := handleCity(newTestCityEditions(t), "", false, "")
+
+	tests := []struct {
+		query  string
+		radius uint32
+	}{
+		{"", 20},
+		{"&accuracy_unit=km", 20},
+		{"&accuracy_unit=m", 20000},
+	}
+	for _, test := range tests {
+		var resolved struct {
+			AccuracyRadius uint32 `json:"accuracy_radius"`
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/city?ip=195.50.209.246&edition=GeoLite2-City"+test.query, nil)
+		serveTest(t, handler, req, http.StatusOK, &resolved)
+		if resolved.AccuracyRadius != test.radius {
+			t.Errorf("%q: expected accuracy radius %d, got %d", test.query, test.radius, resolved.AccuracyRadius)
+		}
+	}
+
+	var message string
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/city?ip=195.50.209.246&accuracy_unit=mi", nil)
+	serveTest(t, handler, req, http.StatusBadRequest, &message)
+}
+
+func TestCityLangs(t *testing.T) {
+	handler := handleCity(newTestCityEditions(t), "", false, "")
+
+	tests := []struct {
+		langs     string
+		city      string
+		cityNames map[string]string
+	}{
+		{"", "Tallinn", nil},
+		{"ru,en", "Таллин", map[string]string{"ru": "Таллин", "en": "Tallinn"}},
+		{"fr, en", "Tallinn", map[string]string{"en": "Tallinn"}},
+	}
+	for _, test := range tests {
+		var resolved struct {
+			City      string            `json:"city"`
+			CityNames map[string]string `json:"city_names"`
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/city?ip=195.50.209.246&edition=GeoLite2-City&langs="+url.QueryEscape(test.langs), nil)
+		serveTest(t, handler, req, http.StatusOK, &resolved)
+		if resolved.City != test.city || !maps.Equal(resolved.CityNames, test.cityNames) {
+			t.Errorf("langs %q: unexpected result %+v", test.langs, resolved)
+		}
+	}
+}
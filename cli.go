@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+)
+
+// runLookup looks up a single IP and prints its record as JSON, for the
+// lookup subcommand
+func runLookup(db *GeoIPDatabase, rawIP string) error {
+	ip := net.ParseIP(rawIP)
+	if ip == nil {
+		return errors.New("failed to parse ip")
+	}
+
+	record, err := db.GetRecord(ip)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		IP     string       `json:"ip"`
+		Record *GeoIPRecord `json:"record"`
+	}{
+		IP:     ip.String(),
+		Record: record,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// coordinateDecimals is how many decimal places coordinates are formatted
+// with as strings. GeoIP2 databases don't have more precision than that.
+const coordinateDecimals = 4
+
+// coordinate is a latitude or a longitude, encoded either as a JSON number
+// or as a string, for clients whose JSON parsers mangle floats
+type coordinate struct {
+	value    float64
+	asString bool
+}
+
+func newCoordinate(value *float64, asString bool) *coordinate {
+	if value == nil {
+		return nil
+	}
+	return &coordinate{value: *value, asString: asString}
+}
+
+func (c coordinate) MarshalJSON() ([]byte, error) {
+	if c.asString {
+		return json.Marshal(strconv.FormatFloat(c.value, 'f', coordinateDecimals, 64))
+	}
+	return json.Marshal(c.value)
+}
+
+// accuracyRadiusUnit reads the unit accuracy radiuses should be returned in
+// from the accuracy_unit query parameter, as the number of meters in it.
+// On failure an error response is written and false is returned.
+func accuracyRadiusUnit(w http.ResponseWriter, r *http.Request) (uint32, bool) {
+	switch unit := r.URL.Query().Get("accuracy_unit"); unit {
+	case "", "km":
+		return 1000, true
+	case "m":
+		return 1, true
+	default:
+		writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("unsupported accuracy unit %q, expected km or m", unit))
+		return 0, false
+	}
+}
+
+// newAccuracyRadius converts an accuracy radius from the database, which is
+// in kilometers, into the given unit
+func newAccuracyRadius(radius *uint16, unit uint32) *uint32 {
+	if radius == nil {
+		return nil
+	}
+	converted := uint32(*radius) * 1000 / unit
+	return &converted
+}
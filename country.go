@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// handleCountry resolves a single IP into its country, and optionally more
+// details of it as asked for in the query.
+func handleCountry(dbs *editionDatabases, ipJSONPath string, strictJSON bool, responseCacheControl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		rawIP, ip, ok := parseRequestIP(w, r, ipJSONPath, strictJSON)
+		if !ok {
+			return
+		}
+		normalizedIP := ip.String()
+
+		// Lookup
+		record, err := db.GetRecord(ip)
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err)
+			return
+		}
+
+		resolved := resolvedIP{
+			IP:      normalizedIP,
+			Country: record.Country.ISOCode,
+		}
+		if r.URL.Query().Get("include_continent") == "true" {
+			resolved.Continent = record.Continent.Code
+		}
+		langs := requestLangs(r)
+		if len(langs) > 0 {
+			resolved.CountryNames = localizedNames(record.Country.Names, langs)
+			if len(record.City.Names) > 0 {
+				resolved.CityNames = localizedNames(record.City.Names, langs)
+			}
+		}
+		if r.URL.Query().Get("include_languages") == "true" && record.Country.ISOCode != nil {
+			resolved.Languages = countryLanguages[*record.Country.ISOCode]
+		}
+		if r.URL.Query().Get("include_db_age") == "true" {
+			buildEpoch, err := db.BuildEpoch()
+			if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+				return
+			}
+			age := int64(time.Since(buildEpoch).Seconds())
+			resolved.DatabaseAge = &age
+		}
+		if r.URL.Query().Get("include_family") == "true" {
+			addr, _ := netip.ParseAddr(rawIP)
+			family := "v6"
+			if addr.Is4() {
+				family = "v4"
+			}
+			mapped := addr.Is4In6()
+			resolved.AddressFamily = &family
+			resolved.IPv4Mapped = &mapped
+		}
+
+		if r.URL.Query().Get("include_prefix_len") == "true" {
+			resolved.PrefixLength = &record.PrefixLength
+		}
+
+		if r.URL.Query().Get("include_location") == "true" {
+			// Saying so beats an always empty location when the edition
+			// doesn't have any
+			hasLocation, err := db.HasLocation()
+			if err != nil {
+				writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+				return
+			} else if !hasLocation {
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("edition %q has no location data, use a City edition", db.edition()))
+				return
+			}
+
+			accuracyUnit, ok := accuracyRadiusUnit(w, r)
+			if !ok {
+				return
+			}
+			coordsAsString := r.URL.Query().Get("coords_as_string") == "true"
+			resolved.Location = &resolvedIPLocation{
+				Latitude:       newCoordinate(record.Location.Latitude, coordsAsString),
+				Longitude:      newCoordinate(record.Location.Longitude, coordsAsString),
+				AccuracyRadius: newAccuracyRadius(record.Location.AccuracyRadius, accuracyUnit),
+				TimeZone:       record.Location.TimeZone,
+			}
+		}
+
+		if len(responseCacheControl) > 0 {
+			w.Header().Set("Cache-Control", responseCacheControl)
+		}
+		writeNegotiatedResponse(w, r, http.StatusOK, resolved, lookupCSVHeader, [][]string{lookupCSVRow(normalizedIP, record, langs)})
+	}
+}
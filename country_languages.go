@@ -0,0 +1,257 @@
+package main
+
+// countryLanguages maps country ISO codes to their official (or de facto
+// national) languages as BCP 47 language tags. Regional and minority
+// languages are left out, so treat it as a sensible default rather than a
+// complete list.
+var countryLanguages = map[string][]string{
+	"AD": {"ca"},
+	"AE": {"ar"},
+	"AF": {"ps", "fa"},
+	"AG": {"en"},
+	"AI": {"en"},
+	"AL": {"sq"},
+	"AM": {"hy"},
+	"AO": {"pt"},
+	"AR": {"es"},
+	"AS": {"en", "sm"},
+	"AT": {"de"},
+	"AU": {"en"},
+	"AW": {"nl", "pap"},
+	"AX": {"sv"},
+	"AZ": {"az"},
+	"BA": {"bs", "hr", "sr"},
+	"BB": {"en"},
+	"BD": {"bn"},
+	"BE": {"nl", "fr", "de"},
+	"BF": {"fr"},
+	"BG": {"bg"},
+	"BH": {"ar"},
+	"BI": {"rn", "fr", "en"},
+	"BJ": {"fr"},
+	"BL": {"fr"},
+	"BM": {"en"},
+	"BN": {"ms"},
+	"BO": {"es", "qu", "ay", "gn"},
+	"BQ": {"nl"},
+	"BR": {"pt"},
+	"BS": {"en"},
+	"BT": {"dz"},
+	"BV": {"nb"},
+	"BW": {"en", "tn"},
+	"BY": {"be", "ru"},
+	"BZ": {"en"},
+	"CA": {"en", "fr"},
+	"CC": {"en"},
+	"CD": {"fr"},
+	"CF": {"fr", "sg"},
+	"CG": {"fr"},
+	"CH": {"de", "fr", "it", "rm"},
+	"CI": {"fr"},
+	"CK": {"en"},
+	"CL": {"es"},
+	"CM": {"en", "fr"},
+	"CN": {"zh"},
+	"CO": {"es"},
+	"CR": {"es"},
+	"CU": {"es"},
+	"CV": {"pt"},
+	"CW": {"nl", "pap", "en"},
+	"CX": {"en"},
+	"CY": {"el", "tr"},
+	"CZ": {"cs"},
+	"DE": {"de"},
+	"DJ": {"fr", "ar"},
+	"DK": {"da"},
+	"DM": {"en"},
+	"DO": {"es"},
+	"DZ": {"ar", "ber"},
+	"EC": {"es"},
+	"EE": {"et"},
+	"EG": {"ar"},
+	"EH": {"ar"},
+	"ER": {"ti", "ar", "en"},
+	"ES": {"es"},
+	"ET": {"am"},
+	"FI": {"fi", "sv"},
+	"FJ": {"en", "fj", "hif"},
+	"FK": {"en"},
+	"FM": {"en"},
+	"FO": {"fo", "da"},
+	"FR": {"fr"},
+	"GA": {"fr"},
+	"GB": {"en"},
+	"GD": {"en"},
+	"GE": {"ka"},
+	"GF": {"fr"},
+	"GG": {"en", "fr"},
+	"GH": {"en"},
+	"GI": {"en"},
+	"GL": {"kl"},
+	"GM": {"en"},
+	"GN": {"fr"},
+	"GP": {"fr"},
+	"GQ": {"es", "fr", "pt"},
+	"GR": {"el"},
+	"GS": {"en"},
+	"GT": {"es"},
+	"GU": {"en", "ch"},
+	"GW": {"pt"},
+	"GY": {"en"},
+	"HK": {"zh", "en"},
+	"HM": {"en"},
+	"HN": {"es"},
+	"HR": {"hr"},
+	"HT": {"fr", "ht"},
+	"HU": {"hu"},
+	"ID": {"id"},
+	"IE": {"ga", "en"},
+	"IL": {"he"},
+	"IM": {"en", "gv"},
+	"IN": {"hi", "en"},
+	"IO": {"en"},
+	"IQ": {"ar", "ku"},
+	"IR": {"fa"},
+	"IS": {"is"},
+	"IT": {"it"},
+	"JE": {"en", "fr"},
+	"JM": {"en"},
+	"JO": {"ar"},
+	"JP": {"ja"},
+	"KE": {"sw", "en"},
+	"KG": {"ky", "ru"},
+	"KH": {"km"},
+	"KI": {"en"},
+	"KM": {"ar", "fr"},
+	"KN": {"en"},
+	"KP": {"ko"},
+	"KR": {"ko"},
+	"KW": {"ar"},
+	"KY": {"en"},
+	"KZ": {"kk", "ru"},
+	"LA": {"lo"},
+	"LB": {"ar"},
+	"LC": {"en"},
+	"LI": {"de"},
+	"LK": {"si", "ta"},
+	"LR": {"en"},
+	"LS": {"st", "en"},
+	"LT": {"lt"},
+	"LU": {"lb", "fr", "de"},
+	"LV": {"lv"},
+	"LY": {"ar"},
+	"MA": {"ar", "zgh"},
+	"MC": {"fr"},
+	"MD": {"ro"},
+	"ME": {"cnr"},
+	"MF": {"fr"},
+	"MG": {"mg", "fr"},
+	"MH": {"mh", "en"},
+	"MK": {"mk"},
+	"ML": {"bm", "fr"},
+	"MM": {"my"},
+	"MN": {"mn"},
+	"MO": {"zh", "pt"},
+	"MP": {"en", "ch"},
+	"MQ": {"fr"},
+	"MR": {"ar"},
+	"MS": {"en"},
+	"MT": {"mt", "en"},
+	"MU": {"en", "fr"},
+	"MV": {"dv"},
+	"MW": {"en", "ny"},
+	"MX": {"es"},
+	"MY": {"ms"},
+	"MZ": {"pt"},
+	"NA": {"en"},
+	"NC": {"fr"},
+	"NE": {"fr"},
+	"NF": {"en"},
+	"NG": {"en"},
+	"NI": {"es"},
+	"NL": {"nl"},
+	"NO": {"nb", "nn"},
+	"NP": {"ne"},
+	"NR": {"na", "en"},
+	"NU": {"en", "niu"},
+	"NZ": {"en", "mi"},
+	"OM": {"ar"},
+	"PA": {"es"},
+	"PE": {"es", "qu", "ay"},
+	"PF": {"fr"},
+	"PG": {"en", "tpi", "ho"},
+	"PH": {"fil", "en"},
+	"PK": {"ur", "en"},
+	"PL": {"pl"},
+	"PM": {"fr"},
+	"PN": {"en"},
+	"PR": {"es", "en"},
+	"PS": {"ar"},
+	"PT": {"pt"},
+	"PW": {"en", "pau"},
+	"PY": {"es", "gn"},
+	"QA": {"ar"},
+	"RE": {"fr"},
+	"RO": {"ro"},
+	"RS": {"sr"},
+	"RU": {"ru"},
+	"RW": {"rw", "en", "fr", "sw"},
+	"SA": {"ar"},
+	"SB": {"en"},
+	"SC": {"crs", "en", "fr"},
+	"SD": {"ar", "en"},
+	"SE": {"sv"},
+	"SG": {"en", "ms", "zh", "ta"},
+	"SH": {"en"},
+	"SI": {"sl"},
+	"SJ": {"nb"},
+	"SK": {"sk"},
+	"SL": {"en"},
+	"SM": {"it"},
+	"SN": {"fr"},
+	"SO": {"so", "ar"},
+	"SR": {"nl"},
+	"SS": {"en"},
+	"ST": {"pt"},
+	"SV": {"es"},
+	"SX": {"nl", "en"},
+	"SY": {"ar"},
+	"SZ": {"en", "ss"},
+	"TC": {"en"},
+	"TD": {"fr", "ar"},
+	"TF": {"fr"},
+	"TG": {"fr"},
+	"TH": {"th"},
+	"TJ": {"tg"},
+	"TK": {"tkl", "en"},
+	"TL": {"pt", "tet"},
+	"TM": {"tk"},
+	"TN": {"ar"},
+	"TO": {"to", "en"},
+	"TR": {"tr"},
+	"TT": {"en"},
+	"TV": {"tvl", "en"},
+	"TW": {"zh"},
+	"TZ": {"sw", "en"},
+	"UA": {"uk"},
+	"UG": {"en", "sw"},
+	"UM": {"en"},
+	"US": {"en"},
+	"UY": {"es"},
+	"UZ": {"uz"},
+	"VA": {"it", "la"},
+	"VC": {"en"},
+	"VE": {"es"},
+	"VG": {"en"},
+	"VI": {"en"},
+	"VN": {"vi"},
+	"VU": {"bi", "en", "fr"},
+	"WF": {"fr"},
+	"WS": {"sm", "en"},
+	"XK": {"sq", "sr"},
+	"YE": {"ar"},
+	"YT": {"fr"},
+	"ZA": {"af", "en", "nr", "nso", "ss", "st", "tn", "ts", "ve", "xh", "zu"},
+	"ZM": {"en"},
+	"ZW": {"en", "sn", "nd"},
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handleDBInfo tells which database build is being served
+func handleDBInfo(dbs *editionDatabases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		metadata, err := db.Metadata()
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, metadata)
+	}
+}
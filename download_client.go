@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// newDownloadClient builds the HTTP client used for database downloads.
+// When dnsServer is set, host names are resolved using only that server.
+// When sourceIP is set, all connections (DNS included) originate from it.
+// When proxy is set, it's used instead of the proxy environment variables.
+// Non-zero timeout bounds each request, including reading the body.
+func newDownloadClient(dnsServer string, sourceIP net.IP, proxy *url.URL, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if sourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	if len(dnsServer) > 0 {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				if sourceIP != nil && strings.HasPrefix(network, "udp") {
+					d.LocalAddr = &net.UDPAddr{IP: sourceIP}
+				} else if sourceIP != nil {
+					d.LocalAddr = &net.TCPAddr{IP: sourceIP}
+				}
+				return d.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
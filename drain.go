@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// rejectWhenDraining answers everything but the probes, metrics and admin
+// endpoints with 503 while draining is set. Requests already being served
+// are let to finish.
+func rejectWhenDraining(draining *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz", r.URL.Path == "/readyz", r.URL.Path == "/metrics":
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+		default:
+			if draining.Load() {
+				// Let the client reconnect to an instance still in rotation
+				w.Header().Set("Connection", "close")
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, http.StatusServiceUnavailable, StatusError, "draining")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminDrain starts draining the instance on POST, which fails
+// /healthz and /readyz so that load balancers take it out of rotation, and
+// stops it on DELETE.
+func handleAdminDrain(draining *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPost:
+			draining.Store(true)
+		case http.MethodDelete:
+			draining.Store(false)
+		default:
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, struct {
+			Draining bool `json:"draining"`
+		}{
+			Draining: draining.Load(),
+		})
+	}
+}
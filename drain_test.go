@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	var draining atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/country", handleCountry(newTestEditions(t), "", false, ""))
+	mux.HandleFunc("/admin/drain", handleAdminDrain(&draining))
+	handler := rejectWhenDraining(&draining, mux)
+
+	var state struct {
+		Draining bool `json:"draining"`
+	}
+	serveTest(t, handler, httptest.NewRequest(http.MethodPost, "/admin/drain", nil), http.StatusOK, &state)
+	if !state.Draining {
+		t.Fatal("expected draining to start")
+	}
+
+	var message string
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4", nil)
+	serveTest(t, handler, req, http.StatusServiceUnavailable, &message)
+	if message != "draining" {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	serveTest(t, handler, httptest.NewRequest(http.MethodDelete, "/admin/drain", nil), http.StatusOK, &state)
+	if state.Draining {
+		t.Fatal("expected draining to stop")
+	}
+
+	var resolved resolvedIP
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4", nil)
+	serveTest(t, handler, req, http.StatusOK, &resolved)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// editionDatabases holds one database per configured edition
+type editionDatabases struct {
+	databases      map[string]*GeoIPDatabase
+	defaultEdition string
+}
+
+// defaultDatabase returns the database of the first configured edition
+func (e *editionDatabases) defaultDatabase() *GeoIPDatabase {
+	return e.databases[e.defaultEdition]
+}
+
+// forRequest picks the database of the edition given in the edition query
+// parameter, or the default one. On failure an error response is written
+// and false is returned.
+func (e *editionDatabases) forRequest(w http.ResponseWriter, r *http.Request) (*GeoIPDatabase, bool) {
+	edition := r.URL.Query().Get("edition")
+	if len(edition) == 0 {
+		return e.defaultDatabase(), true
+	}
+
+	db, ok := e.databases[edition]
+	if !ok {
+		writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("edition %q is not configured", edition))
+		return nil, false
+	}
+	return db, true
+}
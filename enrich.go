@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxEnrichRequestSize = 32 << 20
+	defaultEnrichColumn  = "ip"
+)
+
+// handleEnrich resolves an IP column of an uploaded CSV and sends the same
+// CSV back with the lookup columns (lookupCSVHeader without the IP) appended
+// to every row. The whole upload is read and resolved before responding, so
+// that failures are still reported as errors rather than truncated CSV.
+func handleEnrich(dbs *editionDatabases) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "application/json")
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		query := r.URL.Query()
+		column := query.Get("column")
+		if len(column) == 0 {
+			column = defaultEnrichColumn
+		}
+
+		langs := requestLangs(r)
+		cr := csv.NewReader(http.MaxBytesReader(w, r.Body, maxEnrichRequestSize))
+		cr.FieldsPerRecord = -1
+
+		// Figure out which column holds the IP. Numeric columns are indexes and
+		// only imply a header row when asked to, names always do.
+		var header []string
+		columnIndex := -1
+		if v, err := strconv.Atoi(column); err == nil {
+			if v < 0 {
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, http.StatusBadRequest, StatusError, "invalid column index")
+				return
+			}
+			columnIndex = v
+			if query.Get("header") == "true" {
+				if header, err = cr.Read(); err != nil {
+					w.Header().Set("Content-Type", "application/json")
+					writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("failed to read csv header: %s", err))
+					return
+				}
+			}
+		} else {
+			if header, err = cr.Read(); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("failed to read csv header: %s", err))
+				return
+			}
+			for i, name := range header {
+				if strings.TrimSpace(name) == column {
+					columnIndex = i
+					break
+				}
+			}
+			if columnIndex < 0 {
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("column %q not found in csv header", column))
+				return
+			}
+		}
+
+		// Read and resolve everything first. HTTP/1.x servers stop reading
+		// the request body once the response is being written, and a lookup
+		// failing halfway through couldn't be reported anymore.
+		var rows [][]string
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				writeResponse(w, http.StatusBadRequest, StatusError, fmt.Sprintf("failed to read csv: %s", err))
+				return
+			}
+
+			enriched := make([]string, len(lookupCSVHeader)-1)
+			if columnIndex < len(record) {
+				if ip := net.ParseIP(strings.TrimSpace(record[columnIndex])); ip != nil {
+					// Addresses the database can't cover are left empty like any other unknown one
+					if geoRecord, err := db.GetRecord(ip); err != nil && !errors.Is(err, ErrorIPv6NotSupported) {
+						slog.Error("failed to look up ip for enrichment", "ip", ip.String(), "error", err)
+						writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+						return
+					} else if err == nil {
+						enriched = lookupCSVRow(ip.String(), geoRecord, langs)[1:]
+					}
+				}
+			}
+			rows = append(rows, append(record, enriched...))
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		if header != nil {
+			_ = cw.Write(append(header, lookupCSVHeader[1:]...))
+		}
+		_ = cw.WriteAll(rows)
+	}
+}
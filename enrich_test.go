@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Enough rows for the response to outgrow the server's write buffer while
+// the upload is still being read, which a real HTTP/1.1 server doesn't allow
+func TestEnrichManyRows(t *testing.T) {
+	server := httptest.NewServer(handleEnrich(newTestEditions(t)))
+	t.Cleanup(server.Close)
+
+	const rows = 2000
+	var body strings.Builder
+	body.WriteString("user,addr\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&body, "user%d,1.2.3.%d\n", i, i%256)
+	}
+
+	resp, err := http.Post(server.URL+"?column=addr", "text/csv", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != rows+1 {
+		t.Fatalf("expected %d rows, got %d", rows+1, len(records))
+	}
+	if header := strings.Join(records[0], ","); header != "user,addr,country,city,latitude,longitude" {
+		t.Errorf("unexpected header %q", header)
+	}
+	for i, record := range records[1:] {
+		if record[0] != fmt.Sprintf("user%d", i) || record[2] != "DE" {
+			t.Fatalf("unexpected row %d: %v", i, record)
+		}
+	}
+}
+
+func TestEnrichLookupError(t *testing.T) {
+	dbs := newTestEditions(t)
+	handler := handleEnrich(dbs)
+	_ = dbs.defaultDatabase().Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/enrich", strings.NewReader("ip\n1.2.3.4\n"))
+	var message string
+	serveTest(t, handler, req, http.StatusInternalServerError, &message)
+	if message != ErrorDatabaseNotOpen.Error() {
+		t.Errorf("expected %q, got %q", ErrorDatabaseNotOpen.Error(), message)
+	}
+}
+
+func TestEnrichLangs(t *testing.T) {
+	handler := handleEnrich(newTestCityEditions(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/enrich?edition=GeoLite2-City&langs=ru,en", strings.NewReader("ip\n195.50.209.246\n1.2.3.4\n"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][2] != "Таллин" || records[2][2] != "Berlin" {
+		t.Errorf("unexpected rows %v", records)
+	}
+}
@@ -3,267 +3,1388 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	maxminddb "github.com/oschwald/maxminddb-golang"
 )
 
 const (
-	CountryDBURL    = "https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-Country&license_key=@LICENSE_KEY@&suffix=tar.gz"
-	CountryDBMD5URL = CountryDBURL + ".md5"
+	CountryDBEdition = "GeoLite2-Country"
+	CityDBEdition    = "GeoLite2-City"
+	ASNDBEdition     = "GeoLite2-ASN"
 
-	CountryDBName    = "GeoLite2-Country.mmdb"
-	CountryDBMD5Name = CountryDBName + ".md5"
+	DBURL         = "https://download.maxmind.com/app/geoip_download?edition_id=@EDITION@&license_key=@LICENSE_KEY@&suffix=tar.gz"
+	DBChecksumURL = DBURL + ".@CHECKSUM_ALGO@"
+
+	DefaultChecksumAlgorithm = "md5"
 )
 
+// ChecksumAlgorithms maps supported checksum algorithms to their hash
+// implementations. The name is also the suffix of the checksum file.
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
 var (
 	ErrorDatabaseNotOpen           = errors.New("GeoIP database not open")
 	ErrorDatabaseChecksumMismatch  = errors.New("GeoIP database checksum mismatch")
 	ErrorDatabaseNotFoundInArchive = errors.New("GeoIP database not found in downloaded archive")
+	ErrorDatabaseTypeMismatch      = errors.New("GeoIP database type mismatch")
+	ErrorIPv6NotSupported          = errors.New("IPv6 not supported by loaded database")
+	ErrorLookupTimeout             = errors.New("GeoIP lookup timed out")
+	ErrorDownloadInterrupted       = errors.New("GeoIP database download interrupted")
+)
+
+const (
+	defaultRetryAfter = 1 * time.Hour
+	minRetryAfter     = 1 * time.Minute
+
+	// Interrupted downloads are resumed right away this many times, waiting
+	// downloadRetryDelay longer before each attempt
+	maxDownloadAttempts = 3
 )
 
+// downloadRetryDelay is a variable only for tests to not wait on retries
+var downloadRetryDelay = 5 * time.Second
+
+// RateLimitError is returned when the download server is rate limiting us.
+type RateLimitError struct {
+	// RetryAfter is how long to wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by download server, retry after %s", e.RetryAfter)
+}
+
+// GeoIPSubdivision is a subdivision (e.g. a state or a county) of a country
+type GeoIPSubdivision struct {
+	ISOCode *string           `maxminddb:"iso_code" json:"iso_code"`
+	Names   map[string]string `maxminddb:"names" json:"names"`
+}
+
+// GeoIPRecord holds the fields geosvc decodes from database records. Fields
+// which aren't present in the loaded edition stay empty, e.g. everything
+// besides country and continent for Country databases, and everything
+// besides the autonomous system for ASN databases.
+type GeoIPRecord struct {
+	Country struct {
+		ISOCode *string           `maxminddb:"iso_code" json:"iso_code"`
+		Names   map[string]string `maxminddb:"names" json:"names"`
+	} `maxminddb:"country" json:"country"`
+	Continent struct {
+		Code *string `maxminddb:"code" json:"code"`
+	} `maxminddb:"continent" json:"continent"`
+	City struct {
+		Names map[string]string `maxminddb:"names" json:"names"`
+	} `maxminddb:"city" json:"city"`
+	Subdivisions []GeoIPSubdivision `maxminddb:"subdivisions" json:"subdivisions"`
+	Postal       struct {
+		Code *string `maxminddb:"code" json:"code"`
+	} `maxminddb:"postal" json:"postal"`
+	Location struct {
+		AccuracyRadius *uint16  `maxminddb:"accuracy_radius" json:"accuracy_radius"`
+		Latitude       *float64 `maxminddb:"latitude" json:"latitude"`
+		Longitude      *float64 `maxminddb:"longitude" json:"longitude"`
+		TimeZone       *string  `maxminddb:"time_zone" json:"time_zone"`
+	} `maxminddb:"location" json:"location"`
+	AutonomousSystemNumber       *uint   `maxminddb:"autonomous_system_number" json:"autonomous_system_number"`
+	AutonomousSystemOrganization *string `maxminddb:"autonomous_system_organization" json:"autonomous_system_organization"`
+
+	// PrefixLength is the length of the database network the record was
+	// found in, it's not part of the record data itself
+	PrefixLength int `maxminddb:"-" json:"prefix_len"`
+}
+
+func cloneString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func cloneNames(names map[string]string) map[string]string {
+	if names == nil {
+		return nil
+	}
+	c := make(map[string]string, len(names))
+	for lang, name := range names {
+		c[lang] = name
+	}
+	return c
+}
+
+// clone returns a deep copy of the record, so that it can be handed out
+// without callers being able to modify the cached one
+func (r *GeoIPRecord) clone() *GeoIPRecord {
+	c := *r
+	c.Country.ISOCode = cloneString(r.Country.ISOCode)
+	c.Country.Names = cloneNames(r.Country.Names)
+	c.Continent.Code = cloneString(r.Continent.Code)
+	c.City.Names = cloneNames(r.City.Names)
+	if r.Subdivisions != nil {
+		c.Subdivisions = make([]GeoIPSubdivision, len(r.Subdivisions))
+		for i, subdivision := range r.Subdivisions {
+			c.Subdivisions[i] = GeoIPSubdivision{
+				ISOCode: cloneString(subdivision.ISOCode),
+				Names:   cloneNames(subdivision.Names),
+			}
+		}
+	}
+	c.Postal.Code = cloneString(r.Postal.Code)
+	if r.Location.AccuracyRadius != nil {
+		accuracyRadius := *r.Location.AccuracyRadius
+		c.Location.AccuracyRadius = &accuracyRadius
+	}
+	if r.Location.Latitude != nil {
+		latitude := *r.Location.Latitude
+		c.Location.Latitude = &latitude
+	}
+	if r.Location.Longitude != nil {
+		longitude := *r.Location.Longitude
+		c.Location.Longitude = &longitude
+	}
+	c.Location.TimeZone = cloneString(r.Location.TimeZone)
+	if r.AutonomousSystemNumber != nil {
+		asn := *r.AutonomousSystemNumber
+		c.AutonomousSystemNumber = &asn
+	}
+	c.AutonomousSystemOrganization = cloneString(r.AutonomousSystemOrganization)
+	return &c
+}
+
 type GeoIPDatabase struct {
-	dir   string
-	db    *maxminddb.Reader
-	cache *lru.ARCCache
-	mtx   sync.RWMutex
+	// Edition is the MaxMind database edition to download, CountryDBEdition
+	// is used when empty
+	Edition string
+
+	// TolerateDecodeErrors makes lookups treat records which fail to decode
+	// as unknown instead of returning an error.
+	TolerateDecodeErrors bool
+
+	// IPv6LookupPrefix, when non-zero, truncates IPv6 addresses to the given
+	// prefix length before they are looked up and cached.
+	IPv6LookupPrefix int
+
+	// BestEffortIPv6 makes IPv6 lookups against an IPv4-only database return
+	// empty records instead of ErrorIPv6NotSupported
+	BestEffortIPv6 bool
+
+	// SlowLookupThreshold, when non-zero, logs every lookup taking at least
+	// this long
+	SlowLookupThreshold time.Duration
+
+	// DatabaseFileName is the name of the database file both in the
+	// downloaded archive and on disk, the edition name with an .mmdb suffix
+	// is used when empty
+	DatabaseFileName string
+
+	// UpdateWebhook, when set, is notified after a new database has been
+	// downloaded and set up
+	UpdateWebhook string
+
+	// HTTPClient is used for downloading the database, http.DefaultClient is
+	// used when nil
+	HTTPClient *http.Client
+
+	// LocalDatabasePath, when set, is opened as is instead of downloading
+	// the database
+	LocalDatabasePath string
+
+	// ChecksumCacheTTL, when non-zero, lets RefreshDatabase reuse a remote
+	// checksum fetched less than this long ago
+	ChecksumCacheTTL time.Duration
+
+	// StreamDownload makes the database to be unpacked while it's being
+	// downloaded, instead of storing the archive first. Saves disk space,
+	// but interrupted downloads can't be resumed.
+	StreamDownload bool
+
+	// ChecksumAlgorithm is one of ChecksumAlgorithms used for verifying
+	// downloaded archives, DefaultChecksumAlgorithm is used when empty
+	ChecksumAlgorithm string
+
+	// MaxIterationNetworks, when non-zero, bounds how many networks a single
+	// call walking through the database may visit. KnownCountries is exempt.
+	MaxIterationNetworks int
+
+	// CacheTTL, when non-zero, makes cached lookups older than this count as
+	// misses. The cache is purged on every database update regardless.
+	CacheTTL time.Duration
+
+	// CacheTTLJitter, when non-zero, randomizes the TTL of each cached lookup
+	// within this fraction of CacheTTL in either direction, so that lookups
+	// cached at the same time don't all expire at once.
+	CacheTTLJitter float64
+
+	dir      string
+	db       *maxminddb.Reader
+	ipv4Only bool
+	cache    *lru.ARCCache
+	mtx      sync.RWMutex
+
+	// Serializes updates. Downloading happens without holding mtx, which is
+	// only taken for switching to the new database.
+	updateMtx sync.Mutex
+
+	// Whether db is open, readable without mtx so that readiness checks
+	// don't wait for an update to finish
+	ready atomic.Bool
+
+	// Cache capacity and lookups served from/past it, see CacheStats
+	cacheSize   int
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	// Path of the open database, for walking it without holding up lookups
+	databasePath string
+
+	// Distinct country codes in the open database, computed on first use
+	knownCountries    *knownCountries
+	knownCountriesMtx sync.Mutex
+
+	// Last fetched remote checksum, guarded by updateMtx
+	remoteChecksum          string
+	remoteChecksumFetchedAt time.Time
+
+	// Until when the download server asked us to back off. Not guarded by
+	// mtx, so that it can be checked while an update is running.
+	rateLimitedUntil    time.Time
+	rateLimitedUntilMtx sync.Mutex
+}
+
+// cachedRecord is a cache entry, remembering when it was added and how much
+// its TTL is scaled for CacheTTL, and when it was last looked up for
+// CacheEntry
+type cachedRecord struct {
+	record       *GeoIPRecord
+	addedAt      time.Time
+	ttlScale     float64
+	lastLookupAt atomic.Int64
+}
+
+// newCachedRecord creates a cache entry with its TTL scaled by a random
+// factor within 1 ± jitter
+func newCachedRecord(record *GeoIPRecord, addedAt time.Time, jitter float64) *cachedRecord {
+	c := &cachedRecord{record: record, addedAt: addedAt, ttlScale: 1}
+	if jitter > 0 {
+		c.ttlScale += jitter * (2*rand.Float64() - 1)
+	}
+	c.lastLookupAt.Store(addedAt.UnixNano())
+	return c
 }
 
+// ttl returns the TTL of the entry when the configured one is ttl
+func (c *cachedRecord) ttl(ttl time.Duration) time.Duration {
+	return time.Duration(float64(ttl) * c.ttlScale)
+}
+
+func (c *cachedRecord) expired(ttl time.Duration) bool {
+	return ttl > 0 && time.Since(c.addedAt) >= c.ttl(ttl)
+}
+
+// NewGeoIPDatabase sets up a database stored in dataDirectory, caching up to
+// cacheSize lookups. A cacheSize of 0 disables caching.
 func NewGeoIPDatabase(dataDirectory string, cacheSize int) *GeoIPDatabase {
-	ipCache, err := lru.NewARC(cacheSize)
-	if err != nil {
-		log.Panic(err)
+	var ipCache *lru.ARCCache
+	if cacheSize != 0 {
+		var err error
+		if ipCache, err = lru.NewARC(cacheSize); err != nil {
+			log.Panic(err)
+		}
 	}
 
 	return &GeoIPDatabase{
-		dir:   dataDirectory,
-		cache: ipCache,
+		dir:       dataDirectory,
+		cache:     ipCache,
+		cacheSize: cacheSize,
 	}
 }
 
-func (g *GeoIPDatabase) SetupDatabase(accountId int, licenseKey string) error {
-	if accountId <= 0 {
-		return errors.New("invalid account id")
+// SetupDatabase downloads the database if there's a newer one available, and
+// (re)opens it. The remote checksum is always fetched. With LocalDatabasePath
+// set, that file is (re)opened instead and the credentials are ignored.
+// Returns whether a new database was downloaded.
+func (g *GeoIPDatabase) SetupDatabase(accountId int, licenseKey string) (bool, error) {
+	return g.SetupDatabaseContext(context.Background(), accountId, licenseKey)
+}
+
+// SetupDatabaseContext is SetupDatabase which gives up on downloading once
+// ctx is done.
+func (g *GeoIPDatabase) SetupDatabaseContext(ctx context.Context, accountId int, licenseKey string) (bool, error) {
+	return g.setupDatabase(ctx, accountId, licenseKey, false)
+}
+
+// RefreshDatabase is SetupDatabase which reuses the last fetched remote
+// checksum if it's younger than ChecksumCacheTTL, so that frequent on-demand
+// update checks don't each hit the download server.
+func (g *GeoIPDatabase) RefreshDatabase(accountId int, licenseKey string) (bool, error) {
+	return g.RefreshDatabaseContext(context.Background(), accountId, licenseKey)
+}
+
+// RefreshDatabaseContext is RefreshDatabase which gives up on downloading
+// once ctx is done.
+func (g *GeoIPDatabase) RefreshDatabaseContext(ctx context.Context, accountId int, licenseKey string) (bool, error) {
+	return g.setupDatabase(ctx, accountId, licenseKey, true)
+}
+
+func (g *GeoIPDatabase) setupDatabase(ctx context.Context, accountId int, licenseKey string, useCachedChecksum bool) (bool, error) {
+	updated, err := g.updateDatabase(ctx, accountId, licenseKey, useCachedChecksum)
+
+	// Any other outcome means the download server let us through
+	g.rateLimitedUntilMtx.Lock()
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		g.rateLimitedUntil = time.Now().Add(rateLimitErr.RetryAfter)
+	} else {
+		g.rateLimitedUntil = time.Time{}
 	}
+	g.rateLimitedUntilMtx.Unlock()
 
-	g.mtx.Lock()
-	defer g.mtx.Unlock()
+	return updated, err
+}
+
+// RateLimitedUntil returns until when the download server has asked us to
+// back off, if it currently has.
+func (g *GeoIPDatabase) RateLimitedUntil() (time.Time, bool) {
+	g.rateLimitedUntilMtx.Lock()
+	defer g.rateLimitedUntilMtx.Unlock()
 
-	databasePath := filepath.Join(g.dir, CountryDBName)
-	builtURL := strings.ReplaceAll(CountryDBURL, "@LICENSE_KEY@", licenseKey)
-	builtMD5URL := strings.ReplaceAll(CountryDBMD5URL, "@LICENSE_KEY@", licenseKey)
+	if !time.Now().Before(g.rateLimitedUntil) {
+		return time.Time{}, false
+	}
+	return g.rateLimitedUntil, true
+}
+
+func (g *GeoIPDatabase) updateDatabase(ctx context.Context, accountId int, licenseKey string, useCachedChecksum bool) (bool, error) {
+	g.updateMtx.Lock()
+	defer g.updateMtx.Unlock()
+
+	if len(g.LocalDatabasePath) > 0 {
+		_, err := g.openDatabase(g.LocalDatabasePath)
+		return false, err
+	}
+
+	if accountId <= 0 {
+		return false, errors.New("invalid account id")
+	}
+
+	databaseFileName := g.databaseFileName()
+	databasePath := filepath.Join(g.dir, databaseFileName)
+	checksumAlgorithm := g.checksumAlgorithm()
+	newHash, ok := ChecksumAlgorithms[checksumAlgorithm]
+	if !ok {
+		return false, fmt.Errorf("unsupported checksum algorithm %q", checksumAlgorithm)
+	}
+	urlReplacer := strings.NewReplacer("@EDITION@", g.edition(), "@LICENSE_KEY@", licenseKey, "@CHECKSUM_ALGO@", checksumAlgorithm)
+	builtURL := urlReplacer.Replace(DBURL)
+	builtChecksumURL := urlReplacer.Replace(DBChecksumURL)
 
 	// Determine if update should be downloaded
 	lastDownloadedChecksum := ""
 	shouldDownload := false
-	lastDownloadedChecksumPath := filepath.Join(g.dir, CountryDBMD5Name)
+	lastDownloadedChecksumPath := filepath.Join(g.dir, databaseFileName+"."+checksumAlgorithm)
 	if !fileExists(databasePath) || !fileExists(lastDownloadedChecksumPath) {
 		// Can't be sure, let's download
-		log.Print("either database or its last checksum is not present, will download new database")
+		slog.Info("either database or its last checksum is not present, will download new database", "edition", g.edition())
 		shouldDownload = true
 	} else {
-		log.Print("checking for database updates...")
+		slog.Debug("checking for database updates", "edition", g.edition())
 
 		// Read last downloaded checksum
 		if d, err := os.ReadFile(lastDownloadedChecksumPath); err != nil {
-			return err
+			return false, err
 		} else {
-			lastDownloadedChecksum = string(d)
+			lastDownloadedChecksum = normalizeChecksum(string(d))
 		}
 
-		// Download remote
-		if resp, err := http.Get(builtMD5URL); err != nil {
-			return err
-		} else if checksum, err := io.ReadAll(resp.Body); err != nil {
-			return err
-		} else if normalizedChecksum := strings.TrimSpace(string(checksum)); normalizedChecksum != lastDownloadedChecksum {
+		// Download remote, unless it was fetched recently enough
+		remoteChecksum := g.remoteChecksum
+		if useCachedChecksum && len(remoteChecksum) > 0 && time.Since(g.remoteChecksumFetchedAt) < g.ChecksumCacheTTL {
+			slog.Debug("using recently fetched remote checksum", "edition", g.edition(), "checksum", remoteChecksum)
+		} else if checksum, err := fetchChecksum(ctx, g.httpClient(), builtChecksumURL); err != nil {
+			return false, err
+		} else {
+			remoteChecksum = checksum
+			g.remoteChecksum = remoteChecksum
+			g.remoteChecksumFetchedAt = time.Now()
+		}
+
+		if remoteChecksum != lastDownloadedChecksum {
 			// Download the database
-			log.Print("update available")
+			slog.Info("update available", "edition", g.edition(), "checksum", remoteChecksum)
 			shouldDownload = true
-			lastDownloadedChecksum = normalizedChecksum
+			lastDownloadedChecksum = remoteChecksum
 		} else {
 			// No update found, simply return if database is already set up
-			log.Print("no update found")
-			if g.db != nil {
-				return nil
+			slog.Info("no update found", "edition", g.edition(), "checksum", remoteChecksum)
+			if g.ready.Load() {
+				return false, nil
 			}
 		}
 	}
 
 	// Download
+	var db *maxminddb.Reader
 	if shouldDownload {
-		log.Print("downloading new database")
+		slog.Info("downloading new database", "edition", g.edition())
 
-		databaseArchivePath := filepath.Join(g.dir, "GeoLite2-Country.tar.gz")
-		newDatabasePath := filepath.Join(g.dir, "GeoLite2-Country.mmdb.new")
-		newChecksumPath := filepath.Join(g.dir, "last-downloaded.md5.new")
+		databaseArchivePath := filepath.Join(g.dir, g.edition()+".tar.gz")
+		databaseArchiveChecksumPath := databaseArchivePath + "." + checksumAlgorithm
+		newDatabasePath := filepath.Join(g.dir, databaseFileName+".new")
+		newChecksumPath := lastDownloadedChecksumPath + ".new"
 
-		// Download the database archive
-		downloadedDatabaseArchiveChecksum := ""
-		if r, err := http.Get(builtURL); err != nil {
-			return err
-		} else {
-			if f, err := os.Create(databaseArchivePath); err != nil {
-				return err
+		// Also download checksum if it's not downloaded yet. It's needed
+		// before the download to tell which build a partial archive is of.
+		if len(lastDownloadedChecksum) == 0 {
+			if checksum, err := fetchChecksum(ctx, g.httpClient(), builtChecksumURL); err != nil {
+				return false, err
 			} else {
-				defer func() { _ = f.Close() }()
-
-				h := md5.New()
-				r := io.TeeReader(r.Body, h)
-
-				if _, err := io.Copy(f, r); err != nil {
-					return nil
-				}
-
-				downloadedDatabaseArchiveChecksum = fmt.Sprintf("%x", h.Sum(nil))
+				lastDownloadedChecksum = checksum
 			}
 		}
 
-		// Also download checksum if it's not downloaded yet
-		if len(lastDownloadedChecksum) == 0 {
-			if resp, err := http.Get(builtMD5URL); err != nil {
-				return err
-			} else if checksum, err := io.ReadAll(resp.Body); err != nil {
-				return err
+		downloadedDatabaseArchiveChecksum := ""
+		if g.StreamDownload {
+			// Unpack the database straight from the response
+			if checksum, err := g.streamDatabase(ctx, builtURL, newHash, databaseFileName, newDatabasePath); err != nil {
+				_ = os.Remove(newDatabasePath)
+				return false, err
 			} else {
-				lastDownloadedChecksum = strings.ToLower(strings.TrimSpace(string(checksum)))
+				downloadedDatabaseArchiveChecksum = checksum
+			}
+		} else {
+			// Flaky connections shouldn't postpone the update (or leave a
+			// fresh instance without a database) until the next check
+			for attempt := 1; ; attempt++ {
+				checksum, err := g.downloadArchive(ctx, builtURL, newHash, databaseArchivePath, databaseArchiveChecksumPath, lastDownloadedChecksum)
+				if err == nil {
+					downloadedDatabaseArchiveChecksum = checksum
+					break
+				}
+				if !errors.Is(err, ErrorDownloadInterrupted) || attempt == maxDownloadAttempts || ctx.Err() != nil {
+					return false, err
+				}
+
+				delay := time.Duration(attempt) * downloadRetryDelay
+				slog.Warn("database download interrupted, resuming", "edition", g.edition(), "error", err, "attempt", attempt, "retry_in", delay.String())
+				select {
+				case <-ctx.Done():
+					return false, ctx.Err()
+				case <-time.After(delay):
+				}
 			}
 		}
 
 		// Compare checksums
 		if downloadedDatabaseArchiveChecksum != lastDownloadedChecksum {
-			log.Printf("%s != %s", downloadedDatabaseArchiveChecksum, lastDownloadedChecksum)
-			//_ = os.Remove(newDatabasePath)
+			slog.Error("database checksum mismatch", "edition", g.edition(), "checksum", downloadedDatabaseArchiveChecksum, "expected_checksum", lastDownloadedChecksum)
+			// Don't try to resume a broken archive next time
+			_ = os.Remove(databaseArchivePath)
+			_ = os.Remove(databaseArchiveChecksumPath)
+			if g.StreamDownload {
+				_ = os.Remove(newDatabasePath)
+			}
 			//_ = os.Remove(newChecksumPath)
-			return ErrorDatabaseChecksumMismatch
+			return false, ErrorDatabaseChecksumMismatch
 		}
 
 		// Unpack database archive and find the mmdb file
-		if archive, err := os.Open(databaseArchivePath); err != nil {
-			return err
-		} else if gr, err := gzip.NewReader(archive); err != nil {
-			return err
-		} else {
-			defer func() { _ = archive.Close() }()
-			defer func() { _ = gr.Close() }()
-			tr := tar.NewReader(gr)
-
-			databaseFound := false
-			for {
-				h, err := tr.Next()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					return err
+		if !g.StreamDownload {
+			if archive, err := os.Open(databaseArchivePath); err != nil {
+				return false, err
+			} else {
+				defer func() { _ = archive.Close() }()
+				if err := extractDatabase(archive, databaseFileName, newDatabasePath); err != nil {
+					return false, err
 				}
 
-				baseName := path.Base(h.Name)
-				if baseName != "GeoLite2-Country.mmdb" {
-					continue
+				// Delete database archive
+				if err := os.Remove(databaseArchivePath); err != nil {
+					slog.Warn("failed to delete database archive", "path", databaseArchivePath, "error", err)
 				}
-				// Database file exists, also copy it over
-				databaseFound = true
-
-				// Open database file
-				if f, err := os.Create(newDatabasePath); err != nil {
-					return err
-				} else {
-					defer func() { _ = f.Close() }()
-					if _, err := io.Copy(f, tr); err != nil {
-						return err
-					}
-				}
-
-				break
-			}
-
-			if !databaseFound {
-				return ErrorDatabaseNotFoundInArchive
+				_ = os.Remove(databaseArchiveChecksumPath)
 			}
+		}
 
-			log.Print("database downloaded")
+		slog.Info("database downloaded", "edition", g.edition(), "checksum", lastDownloadedChecksum)
 
-			// Delete database archive
-			if err := os.Remove(databaseArchivePath); err != nil {
-				log.Printf("failed to delete database archive: %s", err)
-			}
+		// Make sure the new database is usable before it replaces anything,
+		// a bad one must not survive a restart either
+		newDB, err := g.loadDatabase(newDatabasePath)
+		if err != nil {
+			_ = os.Remove(newDatabasePath)
+			return false, err
 		}
 
 		// Save checksum
 		if err := os.WriteFile(newChecksumPath, []byte(lastDownloadedChecksum), 0644); err != nil {
-			log.Printf("failed to save last downloaded checksum: %s", err)
+			slog.Warn("failed to save last downloaded checksum", "path", newChecksumPath, "error", err)
 		}
 
-		// Atomically replace database and its checksum files
+		// Atomically replace database and its checksum files. The opened
+		// database keeps working after the rename, it's the same file.
 		if err := os.Rename(newDatabasePath, databasePath); err != nil {
-			return err
+			_ = newDB.Close()
+			return false, err
 		}
 		if err := os.Rename(newChecksumPath, lastDownloadedChecksumPath); err != nil {
-			return err
+			_ = newDB.Close()
+			return false, err
+		}
+
+		g.mtx.Lock()
+		g.useDatabase(newDB, databasePath)
+		g.mtx.Unlock()
+		db = newDB
+	} else {
+		var err error
+		if db, err = g.openDatabase(databasePath); err != nil {
+			return false, err
 		}
 	}
 
-	if g.db != nil {
-		if err := g.db.Close(); err != nil {
-			fmt.Printf("failed to close previous database: %s", err)
+	if shouldDownload && len(g.UpdateWebhook) > 0 {
+		notifyUpdateWebhook(g.UpdateWebhook, updateWebhookPayload{
+			Edition:    g.edition(),
+			BuildEpoch: db.Metadata.BuildEpoch,
+			Checksum:   lastDownloadedChecksum,
+		})
+	}
+
+	return shouldDownload, nil
+}
+
+// downloadArchive downloads the database archive into archivePath and returns
+// its checksum. The archive left behind by an interrupted download is resumed
+// where it left off, but only if it's of the same build: expectedChecksum is
+// recorded into archiveChecksumPath, and a partial archive with a different
+// (or no) recorded checksum is downloaded again from scratch.
+func (g *GeoIPDatabase) downloadArchive(ctx context.Context, url string, newHash func() hash.Hash, archivePath, archiveChecksumPath, expectedChecksum string) (string, error) {
+	partialSize := int64(0)
+	if fi, err := os.Stat(archivePath); err == nil {
+		if d, err := os.ReadFile(archiveChecksumPath); err == nil && normalizeChecksum(string(d)) == expectedChecksum {
+			partialSize = fi.Size()
+		} else {
+			slog.Info("discarding partial database download of another build", "edition", g.edition(), "path", archivePath)
+		}
+	}
+	if partialSize == 0 {
+		if err := os.WriteFile(archiveChecksumPath, []byte(expectedChecksum), 0644); err != nil {
+			return "", err
 		}
 	}
 
-	// Open database
-	db, err := maxminddb.Open(databasePath)
+	r, err := downloadRange(ctx, g.httpClient(), url, partialSize)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = r.Body.Close() }()
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if r.StatusCode == http.StatusPartialContent {
+		slog.Info("resuming database download", "edition", g.edition(), "offset", partialSize)
+		flags = os.O_RDWR | os.O_CREATE
+	}
+
+	f, err := os.OpenFile(archivePath, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	// Hash the already downloaded part first, this also seeks to the end of
+	// the file for appending
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, io.TeeReader(&contextReader{ctx: ctx, r: r.Body}, h)); err != nil {
+		// Whatever was received so far is kept for resuming, unless the
+		// archive itself couldn't be written
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			_ = f.Close()
+			_ = os.Remove(archivePath)
+			_ = os.Remove(archiveChecksumPath)
+			return "", fmt.Errorf("failed to download database: %w", err)
+		}
+		return "", fmt.Errorf("%w: %w", ErrorDownloadInterrupted, err)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// streamDatabase downloads the database archive and unpacks the database
+// file from it on the fly, without storing the archive. Returns the
+// checksum of the whole archive.
+func (g *GeoIPDatabase) streamDatabase(ctx context.Context, url string, newHash func() hash.Hash, databaseFileName, destination string) (string, error) {
+	resp, err := downloadRange(ctx, g.httpClient(), url, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	h := newHash()
+	r := io.TeeReader(&contextReader{ctx: ctx, r: resp.Body}, h)
+	if err := extractDatabase(r, databaseFileName, destination); err != nil {
+		return "", err
+	}
+
+	// The checksum covers the rest of the archive too
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// extractDatabase finds the database file from a tar.gz archive and writes
+// it to destination.
+func extractDatabase(archive io.Reader, databaseFileName, destination string) error {
+	gr, err := gzip.NewReader(archive)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = gr.Close() }()
+	tr := tar.NewReader(gr)
 
-	g.db = db
-	g.cache.Purge()
-	log.Print("database set up")
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return ErrorDatabaseNotFoundInArchive
+		}
+		if err != nil {
+			return err
+		}
 
-	return nil
+		if path.Base(h.Name) != databaseFileName {
+			continue
+		}
+
+		f, err := os.Create(destination)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = f.Close() }()
+
+		_, err = io.Copy(f, tr)
+		return err
+	}
+}
+
+// openDatabase opens the database at databasePath and replaces the current
+// one with it, provided that it's what we asked for. Lookups are held up only
+// for the replacing.
+func (g *GeoIPDatabase) openDatabase(databasePath string) (*maxminddb.Reader, error) {
+	db, err := g.loadDatabase(databasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.useDatabase(db, databasePath)
+	return db, nil
+}
+
+// loadDatabase opens the database at databasePath and checks that it's of
+// the configured edition, without touching the one being served.
+func (g *GeoIPDatabase) loadDatabase(databasePath string) (*maxminddb.Reader, error) {
+	// Open memory maps the file instead of reading it into memory, don't
+	// switch to FromBytes without capping the database size.
+	db, err := maxminddb.Open(databasePath)
+	if err != nil {
+		return nil, err
+	}
+	if databaseType := g.databaseType(); !strings.HasSuffix(db.Metadata.DatabaseType, databaseType) {
+		_ = db.Close()
+		return nil, fmt.Errorf("%w: expected %s database, got %q", ErrorDatabaseTypeMismatch, databaseType, db.Metadata.DatabaseType)
+	}
+
+	return db, nil
 }
 
-func (g *GeoIPDatabase) GetCountryISOCode(IP net.IP) (*string, error) {
+// useDatabase switches to serving db, closing the previous database. g.mtx
+// must be held.
+func (g *GeoIPDatabase) useDatabase(db *maxminddb.Reader, databasePath string) {
+	if g.db != nil {
+		if err := g.db.Close(); err != nil {
+			slog.Warn("failed to close previous database", "edition", g.edition(), "error", err)
+		}
+	}
+
+	g.db = db
+	g.databasePath = databasePath
+	g.ready.Store(true)
+	g.ipv4Only = db.Metadata.IPVersion == 4
+	if g.cache != nil {
+		g.cache.Purge()
+	}
+	g.knownCountriesMtx.Lock()
+	g.knownCountries = nil
+	g.knownCountriesMtx.Unlock()
+	metricDatabaseBuildEpoch.WithLabelValues(g.edition()).Set(float64(db.Metadata.BuildEpoch))
+	slog.Info("database set up", "edition", g.edition(), "path", databasePath, "build_epoch", db.Metadata.BuildEpoch)
+}
+
+// GetRecord looks up the database record for the given IP. Records are
+// cached as decoded, and every caller gets its own copy, so modifying the
+// returned record doesn't affect the cache. The cache is keyed by IP only,
+// anything request specific (such as picking a language) has to be applied
+// when rendering the response.
+//
+// Addresses the database has no data for (private ranges like 10.0.0.1, or
+// anything else without a matching network) are not errors: they resolve to
+// an empty record with every field nil, which is cached like any other so
+// repeated lookups don't walk the tree again. The same goes for records that
+// fail to decode when TolerateDecodeErrors is set.
+func (g *GeoIPDatabase) GetRecord(IP net.IP) (*GeoIPRecord, error) {
+	// Time spent waiting for the lock counts too, that's what usually makes
+	// lookups slow during an update
+	start := time.Now()
+	cacheHit := false
+	if g.SlowLookupThreshold > 0 {
+		defer func() {
+			if took := time.Since(start); took >= g.SlowLookupThreshold {
+				slog.Warn("slow lookup", "ip", IP.String(), "took", took.String(), "cached", cacheHit)
+			}
+		}()
+	}
+
+	metricLookups.Inc()
+
 	g.mtx.RLock()
 	defer g.mtx.RUnlock()
 
 	if g.db == nil {
+		metricLookupErrors.Inc()
 		return nil, ErrorDatabaseNotOpen
 	}
 
+	if g.ipv4Only && IP.To4() == nil {
+		if g.BestEffortIPv6 {
+			return &GeoIPRecord{}, nil
+		}
+		metricLookupErrors.Inc()
+		return nil, ErrorIPv6NotSupported
+	}
+
+	IP = g.lookupIP(IP)
 	normalizedIP := IP.String()
-	var country *string
-	if cached, ok := g.cache.Get(normalizedIP); ok {
-		country = cached.(*string)
+	var record *GeoIPRecord
+	if cached, ok := g.lookupCache(normalizedIP); ok {
+		record = cached
+		cacheHit = true
+		g.cacheHits.Add(1)
+		metricCacheHits.Inc()
 	} else {
-		var record struct {
-			Country struct {
-				ISOCode *string `maxminddb:"iso_code"`
-			} `maxminddb:"country"`
+		g.cacheMisses.Add(1)
+		metricCacheMisses.Inc()
+		record = &GeoIPRecord{}
+		network, found, err := g.db.LookupNetwork(IP, record)
+		if err != nil && g.TolerateDecodeErrors && isDecodeError(err) {
+			slog.Warn("failed to decode record, treating as unknown", "ip", normalizedIP, "error", err)
+			// Partially decoded fields can't be trusted, cache it as not found
+			record = &GeoIPRecord{}
+		} else if err != nil {
+			metricLookupErrors.Inc()
+			return nil, err
+		} else if !found {
+			// Keep the not found sentinel empty even if the decoder touched it
+			record = &GeoIPRecord{}
+		}
+		if network != nil {
+			record.PrefixLength, _ = network.Mask.Size()
 		}
 
-		err := g.db.Lookup(IP, &record)
-		if err != nil {
+		if g.cache != nil {
+			g.cache.Add(normalizedIP, newCachedRecord(record, time.Now(), g.CacheTTLJitter))
+		}
+	}
+
+	return record.clone(), nil
+}
+
+// lookupIP returns the address IP is actually looked up and cached as
+func (g *GeoIPDatabase) lookupIP(IP net.IP) net.IP {
+	if g.IPv6LookupPrefix > 0 && IP.To4() == nil {
+		return IP.Mask(net.CIDRMask(g.IPv6LookupPrefix, 8*net.IPv6len))
+	}
+	return IP
+}
+
+// RecordNetwork returns the network IP's record from GetRecord applies to.
+// That's the database network it was found in, or with IPv6LookupPrefix
+// the truncated network when that's the larger one, as every address in it
+// shares the cached record.
+func (g *GeoIPDatabase) RecordNetwork(IP net.IP, record *GeoIPRecord) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if ip4 := IP.To4(); ip4 != nil {
+		IP, bits = ip4, 8*net.IPv4len
+	}
+	prefixLength := record.PrefixLength
+	if g.IPv6LookupPrefix > 0 && bits == 8*net.IPv6len {
+		prefixLength = min(prefixLength, g.IPv6LookupPrefix)
+	}
+
+	mask := net.CIDRMask(prefixLength, bits)
+	return &net.IPNet{IP: IP.Mask(mask), Mask: mask}
+}
+
+// lookupCache returns the cached record for the IP, unless it has expired
+// or caching is disabled
+func (g *GeoIPDatabase) lookupCache(normalizedIP string) (*GeoIPRecord, bool) {
+	if g.cache == nil {
+		return nil, false
+	}
+	if value, ok := g.cache.Get(normalizedIP); ok {
+		if cached := value.(*cachedRecord); !cached.expired(g.CacheTTL) {
+			cached.lastLookupAt.Store(time.Now().UnixNano())
+			return cached.record, true
+		}
+	}
+	return nil, false
+}
+
+// CacheEntry describes what the lookup cache holds for an IP
+type CacheEntry struct {
+	// IP is the address the lookup is cached as, see IPv6LookupPrefix
+	IP           string     `json:"ip"`
+	Cached       bool       `json:"cached"`
+	AddedAt      *time.Time `json:"added_at,omitempty"`
+	LastLookupAt *time.Time `json:"last_lookup_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// CacheEntry tells whether a lookup of IP would currently be served from
+// the cache, and if so, since when and until when. Expired entries count as
+// not cached. Doesn't count as a use of the entry for the cache itself.
+func (g *GeoIPDatabase) CacheEntry(IP net.IP) CacheEntry {
+	entry := CacheEntry{
+		IP: g.lookupIP(IP).String(),
+	}
+	if g.cache == nil {
+		return entry
+	}
+
+	value, ok := g.cache.Peek(entry.IP)
+	if !ok || value.(*cachedRecord).expired(g.CacheTTL) {
+		return entry
+	}
+	cached := value.(*cachedRecord)
+	lastLookupAt := time.Unix(0, cached.lastLookupAt.Load())
+	entry.Cached = true
+	entry.AddedAt = &cached.addedAt
+	entry.LastLookupAt = &lastLookupAt
+	if g.CacheTTL > 0 {
+		expiresAt := cached.addedAt.Add(cached.ttl(g.CacheTTL))
+		entry.ExpiresAt = &expiresAt
+	}
+	return entry
+}
+
+// GetRecordContext is GetRecord which gives up once ctx is done. The lookup
+// itself can't be interrupted and finishes in the background.
+func (g *GeoIPDatabase) GetRecordContext(ctx context.Context, IP net.IP) (*GeoIPRecord, error) {
+	type result struct {
+		record *GeoIPRecord
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		record, err := g.GetRecord(IP)
+		done <- result{record, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.record, res.err
+	case <-ctx.Done():
+		return nil, ErrorLookupTimeout
+	}
+}
+
+// GetRecordNetwork looks up the database record for the given IP along with
+// the network the record applies to. Networks aren't cached, so this always
+// queries the database. Not found addresses and, with TolerateDecodeErrors,
+// undecodable records get an empty record like with GetRecord. With
+// BestEffortIPv6, IPv6 addresses get an empty
+// record for all of ::/0 from an IPv4-only database.
+func (g *GeoIPDatabase) GetRecordNetwork(IP net.IP) (*GeoIPRecord, *net.IPNet, error) {
+	metricLookups.Inc()
+
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		metricLookupErrors.Inc()
+		return nil, nil, ErrorDatabaseNotOpen
+	}
+
+	if g.ipv4Only && IP.To4() == nil {
+		if g.BestEffortIPv6 {
+			return &GeoIPRecord{}, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}, nil
+		}
+		metricLookupErrors.Inc()
+		return nil, nil, ErrorIPv6NotSupported
+	}
+
+	record := &GeoIPRecord{}
+	network, found, err := g.db.LookupNetwork(IP, record)
+	if err != nil && g.TolerateDecodeErrors && isDecodeError(err) {
+		slog.Warn("failed to decode record, treating as unknown", "ip", IP.String(), "error", err)
+		record = &GeoIPRecord{}
+	} else if err != nil {
+		metricLookupErrors.Inc()
+		return nil, nil, err
+	} else if !found {
+		record = &GeoIPRecord{}
+	}
+	if network != nil {
+		record.PrefixLength, _ = network.Mask.Size()
+	}
+
+	return record, network, nil
+}
+
+// Ready tells whether a database is open and lookups can be served. It
+// doesn't wait for an ongoing update.
+func (g *GeoIPDatabase) Ready() bool {
+	return g.ready.Load()
+}
+
+// BuildEpoch returns the build time of the open database
+func (g *GeoIPDatabase) BuildEpoch() (time.Time, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return time.Time{}, ErrorDatabaseNotOpen
+	}
+
+	return time.Unix(int64(g.db.Metadata.BuildEpoch), 0), nil
+}
+
+// HasLocation tells whether the open database has location data, going by
+// the database type in its metadata. Only City (and Enterprise) editions
+// have it.
+func (g *GeoIPDatabase) HasLocation() (bool, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return false, ErrorDatabaseNotOpen
+	}
+
+	databaseType := g.db.Metadata.DatabaseType
+	return strings.HasSuffix(databaseType, "-City") || strings.HasSuffix(databaseType, "-Enterprise"), nil
+}
+
+// DatabaseMetadata describes the open database
+type DatabaseMetadata struct {
+	Edition      string `json:"edition"`
+	DatabaseType string `json:"database_type"`
+	BuildEpoch   uint   `json:"build_epoch"`
+	IPVersion    uint   `json:"ip_version"`
+	NodeCount    uint   `json:"node_count"`
+	// Checksum of the last downloaded archive, empty for local databases
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Metadata returns the metadata of the open database
+func (g *GeoIPDatabase) Metadata() (*DatabaseMetadata, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return nil, ErrorDatabaseNotOpen
+	}
+
+	metadata := &DatabaseMetadata{
+		Edition:      g.edition(),
+		DatabaseType: g.db.Metadata.DatabaseType,
+		BuildEpoch:   g.db.Metadata.BuildEpoch,
+		IPVersion:    g.db.Metadata.IPVersion,
+		NodeCount:    g.db.Metadata.NodeCount,
+	}
+	if len(g.LocalDatabasePath) == 0 {
+		checksumPath := filepath.Join(g.dir, g.databaseFileName()+"."+g.checksumAlgorithm())
+		if d, err := os.ReadFile(checksumPath); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return nil, err
+		} else {
+			metadata.Checksum = normalizeChecksum(string(d))
 		}
-		country = record.Country.ISOCode
+	}
 
-		g.cache.Add(normalizedIP, country)
+	return metadata, nil
+}
+
+// knownCountries is the result of walking a database for its countries,
+// available once done is closed
+type knownCountries struct {
+	done       chan struct{}
+	buildEpoch uint
+	countries  []string
+	err        error
+}
+
+// KnownCountries returns the build epoch of the open database along with
+// the sorted set of country ISO codes found in it. The set is computed by
+// walking the whole database once and reused until the database is
+// swapped. The walk isn't bound by MaxIterationNetworks, as it's done only
+// once per database and with a reader of its own, so that it doesn't hold
+// up updates.
+func (g *GeoIPDatabase) KnownCountries(ctx context.Context) (uint, []string, error) {
+	g.mtx.RLock()
+	if g.db == nil {
+		g.mtx.RUnlock()
+		return 0, nil, ErrorDatabaseNotOpen
+	}
+
+	g.knownCountriesMtx.Lock()
+	known := g.knownCountries
+	if known == nil {
+		known = &knownCountries{done: make(chan struct{})}
+		g.knownCountries = known
+		go g.walkKnownCountries(known, g.databasePath)
+	}
+	g.knownCountriesMtx.Unlock()
+	g.mtx.RUnlock()
+
+	select {
+	case <-known.done:
+		return known.buildEpoch, known.countries, known.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// walkKnownCountries fills in known from the database at databasePath. A
+// failed walk is forgotten, so that the next call tries again.
+func (g *GeoIPDatabase) walkKnownCountries(known *knownCountries, databasePath string) {
+	defer close(known.done)
+
+	known.buildEpoch, known.countries, known.err = walkCountries(databasePath)
+	if known.err != nil {
+		g.knownCountriesMtx.Lock()
+		if g.knownCountries == known {
+			g.knownCountries = nil
+		}
+		g.knownCountriesMtx.Unlock()
+	}
+}
+
+// walkCountries returns the build epoch and the sorted set of country ISO
+// codes of the database at databasePath
+func walkCountries(databasePath string) (uint, []string, error) {
+	// The served database may be replaced meanwhile, renaming a new file
+	// over this one doesn't affect an already open reader
+	db, err := maxminddb.Open(databasePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	seen := make(map[string]struct{})
+	networks := db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record GeoIPRecord
+		if _, err := networks.Network(&record); err != nil {
+			return 0, nil, err
+		}
+		if record.Country.ISOCode != nil {
+			seen[*record.Country.ISOCode] = struct{}{}
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return 0, nil, err
 	}
 
-	return country, nil
+	countries := make([]string, 0, len(seen))
+	for country := range seen {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return db.Metadata.BuildEpoch, countries, nil
+}
+
+// CountriesWithin returns the sorted set of country ISO codes of all
+// networks overlapping the given prefixes, and whether the walk was cut
+// short by MaxIterationNetworks. With BestEffortIPv6, IPv6 prefixes
+// contribute no countries to an IPv4-only database.
+func (g *GeoIPDatabase) CountriesWithin(prefixes []netip.Prefix) ([]string, bool, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return nil, false, ErrorDatabaseNotOpen
+	}
+
+	seen := make(map[string]struct{})
+	truncated := false
+	walked := 0
+	for _, prefix := range prefixes {
+		if g.ipv4Only && !prefix.Addr().Is4() {
+			if g.BestEffortIPv6 {
+				continue
+			}
+			return nil, false, ErrorIPv6NotSupported
+		}
+		if truncated {
+			break
+		}
+
+		network := &net.IPNet{
+			IP:   prefix.Addr().AsSlice(),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		}
+		networks := g.db.NetworksWithin(network, maxminddb.SkipAliasedNetworks)
+		for networks.Next() {
+			if walked++; g.MaxIterationNetworks > 0 && walked > g.MaxIterationNetworks {
+				truncated = true
+				break
+			}
+
+			var record GeoIPRecord
+			if _, err := networks.Network(&record); err != nil {
+				return nil, false, err
+			}
+			if record.Country.ISOCode != nil {
+				seen[*record.Country.ISOCode] = struct{}{}
+			}
+		}
+		if err := networks.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	countries := make([]string, 0, len(seen))
+	for country := range seen {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return countries, truncated, nil
+}
+
+// NetworksOfASN returns the networks the open (ASN) database assigns to the
+// autonomous system asn, and whether the walk through the whole database was
+// cut short by MaxIterationNetworks.
+func (g *GeoIPDatabase) NetworksOfASN(asn uint) ([]netip.Prefix, bool, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return nil, false, ErrorDatabaseNotOpen
+	}
+
+	var prefixes []netip.Prefix
+	truncated := false
+	walked := 0
+	networks := g.db.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		if walked++; g.MaxIterationNetworks > 0 && walked > g.MaxIterationNetworks {
+			truncated = true
+			break
+		}
+
+		// Only the number is needed, skip decoding the rest
+		var record struct {
+			AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+		}
+		network, err := networks.Network(&record)
+		if err != nil {
+			return nil, false, err
+		}
+		if record.AutonomousSystemNumber != asn {
+			continue
+		}
+
+		addr, _ := netip.AddrFromSlice(network.IP)
+		bits, _ := network.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), bits))
+	}
+	if err := networks.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return prefixes, truncated, nil
+}
+
+type persistedCache struct {
+	BuildEpoch uint                    `json:"build_epoch"`
+	Entries    map[string]*GeoIPRecord `json:"entries"`
+}
+
+// SaveCache writes the currently cached lookups into a file, tagged with
+// the build epoch of the open database. Does nothing when caching is
+// disabled, leaving any previously saved file alone.
+func (g *GeoIPDatabase) SaveCache(cachePath string) error {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return ErrorDatabaseNotOpen
+	}
+	if g.cache == nil {
+		return nil
+	}
+
+	persisted := persistedCache{
+		BuildEpoch: g.db.Metadata.BuildEpoch,
+		Entries:    make(map[string]*GeoIPRecord, g.cache.Len()),
+	}
+	for _, key := range g.cache.Keys() {
+		if cached, ok := g.cache.Peek(key); ok && !cached.(*cachedRecord).expired(g.CacheTTL) {
+			persisted.Entries[key.(string)] = cached.(*cachedRecord).record
+		}
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	newCachePath := cachePath + ".new"
+	if err := os.WriteFile(newCachePath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(newCachePath, cachePath)
+}
+
+// LoadCache populates the cache from a file written by SaveCache and returns
+// the amount of entries loaded. Missing files and files written for another
+// database build are ignored, as is everything when caching is disabled.
+// Loaded entries count as freshly added for CacheTTL.
+func (g *GeoIPDatabase) LoadCache(cachePath string) (int, error) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	if g.db == nil {
+		return 0, ErrorDatabaseNotOpen
+	}
+	if g.cache == nil {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var persisted persistedCache
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return 0, err
+	}
+	if persisted.BuildEpoch != g.db.Metadata.BuildEpoch {
+		return 0, nil
+	}
+
+	now := time.Now()
+	for ip, record := range persisted.Entries {
+		g.cache.Add(ip, newCachedRecord(record, now, g.CacheTTLJitter))
+	}
+
+	return len(persisted.Entries), nil
+}
+
+// CacheStats describes the configuration and the effectiveness of the lookup
+// cache of a database. The counters are nil when caching is disabled, as
+// every lookup would count as a miss.
+type CacheStats struct {
+	Enabled  bool   `json:"enabled"`
+	Policy   string `json:"policy,omitempty"`
+	Capacity int    `json:"capacity"`
+	TTL      string `json:"ttl,omitempty"`
+	Size     int    `json:"size"`
+
+	Hits     *int64   `json:"hits"`
+	Misses   *int64   `json:"misses"`
+	HitRatio *float64 `json:"hit_ratio"`
+}
+
+// CacheStats returns the cache configuration and current size, along with
+// the hits and misses counted since startup, or since the last call with
+// reset set, which zeroes them.
+func (g *GeoIPDatabase) CacheStats(reset bool) CacheStats {
+	stats := CacheStats{
+		Capacity: g.cacheSize,
+	}
+	if g.cache == nil {
+		return stats
+	}
+
+	stats.Enabled = true
+	stats.Policy = "arc"
+	if g.CacheTTL > 0 {
+		stats.TTL = g.CacheTTL.String()
+	}
+	stats.Size = g.cache.Len()
+
+	var hits, misses int64
+	if reset {
+		hits = g.cacheHits.Swap(0)
+		misses = g.cacheMisses.Swap(0)
+	} else {
+		hits = g.cacheHits.Load()
+		misses = g.cacheMisses.Load()
+	}
+	hitRatio := 0.0
+	if lookups := hits + misses; lookups > 0 {
+		hitRatio = float64(hits) / float64(lookups)
+	}
+	stats.Hits = &hits
+	stats.Misses = &misses
+	stats.HitRatio = &hitRatio
+	return stats
+}
+
+// ExpireCache drops cached lookups older than CacheTTL and returns how many
+// were dropped. GetRecord already ignores them, this only frees the memory
+// (and cache slots) sooner.
+func (g *GeoIPDatabase) ExpireCache() int {
+	if g.CacheTTL <= 0 || g.cache == nil {
+		return 0
+	}
+
+	expired := 0
+	for _, key := range g.cache.Keys() {
+		if cached, ok := g.cache.Peek(key); ok && cached.(*cachedRecord).expired(g.CacheTTL) {
+			g.cache.Remove(key)
+			expired++
+		}
+	}
+	return expired
 }
 
 func (g *GeoIPDatabase) Close() error {
@@ -274,10 +1395,162 @@ func (g *GeoIPDatabase) Close() error {
 			return err
 		}
 		g.db = nil
+		g.ready.Store(false)
 	}
 	return nil
 }
 
+func (g *GeoIPDatabase) edition() string {
+	if len(g.Edition) > 0 {
+		return g.Edition
+	}
+	return CountryDBEdition
+}
+
+// databaseType returns the database type family the edition should report
+// in its metadata, e.g. GeoLite2-Country and GeoIP2-Country are both fine
+func (g *GeoIPDatabase) databaseType() string {
+	edition := g.edition()
+	if i := strings.LastIndex(edition, "-"); i >= 0 {
+		return edition[i:]
+	}
+	return edition
+}
+
+func (g *GeoIPDatabase) databaseFileName() string {
+	if len(g.DatabaseFileName) > 0 {
+		return g.DatabaseFileName
+	}
+	return g.edition() + ".mmdb"
+}
+
+func (g *GeoIPDatabase) checksumAlgorithm() string {
+	if len(g.ChecksumAlgorithm) > 0 {
+		return g.ChecksumAlgorithm
+	}
+	return DefaultChecksumAlgorithm
+}
+
+func (g *GeoIPDatabase) httpClient() *http.Client {
+	if g.HTTPClient != nil {
+		return g.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// downloadRange requests url starting from the given byte offset. Servers
+// which don't support ranges simply respond with the whole body, and a
+// range which can't be satisfied is retried as a full download. Responses
+// with anything but the (partial) content are turned into errors, otherwise
+// the caller has to close the body.
+func downloadRange(ctx context.Context, client *http.Client, url string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		_ = resp.Body.Close()
+		return downloadRange(ctx, client, url, 0)
+	}
+	if err := checkRateLimited(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && (offset == 0 || resp.StatusCode != http.StatusPartialContent) {
+		// e.g. 401 for a wrong license key, the body isn't an archive
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to download database: unexpected status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// fetchChecksum downloads a checksum file. Besides the bare checksum, the
+// "<checksum>  <file name>" format of sha256sum and friends is accepted.
+func fetchChecksum(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := checkRateLimited(resp); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download checksum: unexpected status %s", resp.Status)
+	}
+
+	checksum, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(checksum))
+	if len(fields) == 0 {
+		return "", errors.New("downloaded checksum is empty")
+	}
+	return normalizeChecksum(fields[0]), nil
+}
+
+// normalizeChecksum makes hex checksums comparable regardless of where they
+// came from: downloaded, stored on disk or computed
+func normalizeChecksum(checksum string) string {
+	return strings.ToLower(strings.TrimSpace(checksum))
+}
+
+// contextReader fails reads once ctx is done, so that copying a large body
+// can be given up on between reads
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// checkRateLimited turns a 429 response into a RateLimitError, honoring the
+// Retry-After header when present.
+func checkRateLimited(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return nil
+	}
+	_ = resp.Body.Close()
+
+	retryAfter := defaultRetryAfter
+	if v := resp.Header.Get("Retry-After"); len(v) > 0 {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			retryAfter = time.Until(t)
+		}
+	}
+	if retryAfter < minRetryAfter {
+		retryAfter = minRetryAfter
+	}
+
+	return &RateLimitError{RetryAfter: retryAfter}
+}
+
+func isDecodeError(err error) bool {
+	var typeErr maxminddb.UnmarshalTypeError
+	var dbErr maxminddb.InvalidDatabaseError
+	return errors.As(err, &typeErr) || errors.As(err, &dbErr)
+}
+
 func fileExists(path string) bool {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// testCountry builds a Country database record
+func testCountry(isoCode, continentCode string, names map[string]string) mmdbtype.Map {
+	countryNames := mmdbtype.Map{}
+	for lang, name := range names {
+		countryNames[mmdbtype.String(lang)] = mmdbtype.String(name)
+	}
+	return mmdbtype.Map{
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String(isoCode),
+			"names":    countryNames,
+		},
+		"continent": mmdbtype.Map{
+			"code": mmdbtype.String(continentCode),
+		},
+	}
+}
+
+// testDatabaseNetworks is what the test database contains. Reserved
+// networks such as 10.0.0.0/8 are left out, like in the real databases.
+var testDatabaseNetworks = map[string]mmdbtype.Map{
+	"1.2.3.0/24":     testCountry("DE", "EU", map[string]string{"en": "Germany", "de": "Deutschland"}),
+	"8.8.8.0/24":     testCountry("US", "NA", map[string]string{"en": "United States", "de": "Vereinigte Staaten"}),
+	"195.50.0.0/16":  testCountry("EE", "EU", map[string]string{"en": "Estonia", "de": "Estland"}),
+	"2a00:1450::/32": testCountry("DE", "EU", map[string]string{"en": "Germany", "de": "Deutschland"}),
+}
+
+// testCity builds a City database record, which is a Country record with
+// the city and its location added
+func testCity(isoCode, continentCode string, names map[string]string, latitude, longitude float64, accuracyRadius uint16) mmdbtype.Map {
+	record := testCountry(isoCode, continentCode, nil)
+	cityNames := mmdbtype.Map{}
+	for lang, name := range names {
+		cityNames[mmdbtype.String(lang)] = mmdbtype.String(name)
+	}
+	record["city"] = mmdbtype.Map{
+		"names": cityNames,
+	}
+	record["location"] = mmdbtype.Map{
+		"latitude":        mmdbtype.Float64(latitude),
+		"longitude":       mmdbtype.Float64(longitude),
+		"accuracy_radius": mmdbtype.Uint16(accuracyRadius),
+	}
+	return record
+}
+
+// testCityDatabaseNetworks is what the test City database contains
+var testCityDatabaseNetworks = map[string]mmdbtype.Map{
+	"1.2.3.0/24":    testCity("DE", "EU", map[string]string{"en": "Berlin", "de": "Berlin"}, 52.5196, 13.4069, 200),
+	"195.50.0.0/16": testCity("EE", "EU", map[string]string{"en": "Tallinn", "ru": "Таллин"}, 59.437, 24.7535, 20),
+}
+
+// testASN builds an ASN database record
+func testASN(number uint32, organization string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(number),
+		"autonomous_system_organization": mmdbtype.String(organization),
+	}
+}
+
+// testASNDatabaseNetworks is what the test ASN database contains
+var testASNDatabaseNetworks = map[string]mmdbtype.Map{
+	"8.8.4.0/24":          testASN(15169, "GOOGLE"),
+	"8.8.8.0/24":          testASN(15169, "GOOGLE"),
+	"2001:4860::/32":      testASN(15169, "GOOGLE"),
+	"195.50.0.0/16":       testASN(3249, "Telia Eesti AS"),
+	"2a00:1450:4000::/37": testASN(15169, "GOOGLE"),
+}
+
+// writeTestDatabase writes a small Country database into dir and returns
+// its path.
+func writeTestDatabase(t testing.TB, dir string) string {
+	t.Helper()
+	return writeTestEditionDatabase(t, dir, CountryDBEdition, testDatabaseNetworks)
+}
+
+// writeTestEditionDatabase writes a database of the given edition with the
+// given networks into dir and returns its path.
+func writeTestEditionDatabase(t testing.TB, dir, edition string, networks map[string]mmdbtype.Map) string {
+	t.Helper()
+
+	writer, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType: edition,
+		RecordSize:   24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	databasePath := filepath.Join(dir, edition+".mmdb")
+	f, err := os.Create(databasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := writer.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	return databasePath
+}
+
+// newTestDatabase sets up the test database the same way
+// GEOSVC_LOCAL_DB_PATH does.
+func newTestDatabase(t testing.TB) *GeoIPDatabase {
+	t.Helper()
+	return newTestEditionDatabase(t, CountryDBEdition, testDatabaseNetworks)
+}
+
+// newTestEditionDatabase is newTestDatabase for a database of the given
+// edition with the given networks.
+func newTestEditionDatabase(t testing.TB, edition string, networks map[string]mmdbtype.Map) *GeoIPDatabase {
+	t.Helper()
+
+	db := NewGeoIPDatabase(t.TempDir(), 1024)
+	db.Edition = edition
+	db.LocalDatabasePath = writeTestEditionDatabase(t, t.TempDir(), edition, networks)
+	if _, err := db.SetupDatabase(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestGetRecordReturnsCopy(t *testing.T) {
+	db := newTestDatabase(t)
+	ip := net.ParseIP("1.2.3.4")
+
+	record, err := db.GetRecord(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Scribble over everything a careless caller could
+	*record.Country.ISOCode = "XX"
+	record.Country.Names["en"] = "Nowhere"
+	record.Country.Names["xx"] = "Nowhere"
+	record.Continent.Code = nil
+
+	cached, err := db.GetRecord(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Country.ISOCode == nil || *cached.Country.ISOCode != "DE" {
+		t.Errorf("expected country DE, got %v", cached.Country.ISOCode)
+	}
+	if len(cached.Country.Names) != 2 || cached.Country.Names["en"] != "Germany" {
+		t.Errorf("expected untouched country names, got %v", cached.Country.Names)
+	}
+	if cached.Continent.Code == nil || *cached.Continent.Code != "EU" {
+		t.Errorf("expected continent EU, got %v", cached.Continent.Code)
+	}
+	if stats := db.CacheStats(false); *stats.Hits != 1 {
+		t.Errorf("expected the second lookup to be served from the cache, got %+v", stats)
+	}
+}
+
+func TestGetRecordNotFound(t *testing.T) {
+	db := newTestDatabase(t)
+
+	for _, ip := range []string{"10.0.0.1", "192.168.1.1", "fd00::1"} {
+		for i := 0; i < 2; i++ {
+			record, err := db.GetRecord(net.ParseIP(ip))
+			if err != nil {
+				t.Fatalf("expected no error for %s, got %s", ip, err)
+			}
+			if record.Country.ISOCode != nil || record.Continent.Code != nil || record.Country.Names != nil {
+				t.Errorf("expected an empty record for %s, got %+v", ip, record)
+			}
+		}
+	}
+
+	if stats := db.CacheStats(false); stats.Size != 3 || *stats.Hits != 3 || *stats.Misses != 3 {
+		t.Errorf("expected empty records to be cached, got %+v", stats)
+	}
+}
+
+func TestCacheEntry(t *testing.T) {
+	db := newTestDatabase(t)
+	db.CacheTTL = time.Hour
+	db.IPv6LookupPrefix = 48
+	ip := net.ParseIP("2a00:1450:1:2::1")
+
+	if entry := db.CacheEntry(ip); entry.Cached || entry.IP != "2a00:1450:1::" {
+		t.Fatalf("expected %s not to be cached as 2a00:1450:1::, got %+v", ip, entry)
+	}
+
+	if _, err := db.GetRecord(ip); err != nil {
+		t.Fatal(err)
+	}
+	entry := db.CacheEntry(ip)
+	if !entry.Cached || entry.AddedAt == nil || entry.LastLookupAt == nil || entry.ExpiresAt == nil {
+		t.Fatalf("expected %s to be cached, got %+v", ip, entry)
+	}
+	if !entry.ExpiresAt.Equal(entry.AddedAt.Add(time.Hour)) {
+		t.Errorf("expected expiry an hour after %s, got %s", entry.AddedAt, entry.ExpiresAt)
+	}
+
+	if _, err := db.GetRecord(ip); err != nil {
+		t.Fatal(err)
+	}
+	if again := db.CacheEntry(ip); !again.LastLookupAt.After(*entry.LastLookupAt) || !again.AddedAt.Equal(*entry.AddedAt) {
+		t.Errorf("expected only the last lookup time to move, got %+v after %+v", again, entry)
+	}
+
+	db.CacheTTL = time.Nanosecond
+	if entry := db.CacheEntry(ip); entry.Cached {
+		t.Errorf("expected expired entry not to count as cached, got %+v", entry)
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	const ttl = time.Hour
+	now := time.Now()
+
+	if got := newCachedRecord(&GeoIPRecord{}, now, 0).ttl(ttl); got != ttl {
+		t.Errorf("expected TTL %s without jitter, got %s", ttl, got)
+	}
+
+	ttls := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		got := newCachedRecord(&GeoIPRecord{}, now, 0.1).ttl(ttl)
+		if got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("expected TTL within 10%% of %s, got %s", ttl, got)
+		}
+		ttls[got] = struct{}{}
+	}
+	if len(ttls) < 2 {
+		t.Error("expected TTLs to differ between entries")
+	}
+}
+
+func TestCacheStatsDisabled(t *testing.T) {
+	db := NewGeoIPDatabase(t.TempDir(), 0)
+	db.LocalDatabasePath = writeTestDatabase(t, t.TempDir())
+	if _, err := db.SetupDatabase(0, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if _, err := db.GetRecord(net.ParseIP("1.2.3.4")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(db.CacheStats(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"enabled":false,"capacity":0,"size":0,"hits":null,"misses":null,"hit_ratio":null}`; string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+}
+
+// rewriteTransport sends all requests to target instead, for pointing the
+// database downloads at a test server
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newDownloadTestDatabase sets up a database downloading from a test server
+// running handler, into a fresh data directory
+func newDownloadTestDatabase(t *testing.T, handler http.Handler) *GeoIPDatabase {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewGeoIPDatabase(t.TempDir(), 1024)
+	db.HTTPClient = &http.Client{Transport: &rewriteTransport{target: target}}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// isChecksumRequest tells checksum downloads apart from archive downloads
+func isChecksumRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Query().Get("suffix"), "tar.gz.")
+}
+
+func TestSetupDatabaseShortRead(t *testing.T) {
+	defer func(delay time.Duration) { downloadRetryDelay = delay }(downloadRetryDelay)
+	downloadRetryDelay = time.Millisecond
+
+	var archiveRequests atomic.Int32
+	db := newDownloadTestDatabase(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChecksumRequest(r) {
+			_, _ = io.WriteString(w, "d41d8cd98f00b204e9800998ecf8427e")
+			return
+		}
+
+		// Promise more than is sent, the client sees the body end early
+		archiveRequests.Add(1)
+		w.Header().Set("Content-Length", "1024")
+		_, _ = w.Write([]byte("truncated"))
+	}))
+
+	_, err := db.SetupDatabase(1, "test")
+	if !errors.Is(err, ErrorDownloadInterrupted) {
+		t.Fatalf("expected interrupted download error, got %v", err)
+	}
+	if n := archiveRequests.Load(); n != maxDownloadAttempts {
+		t.Errorf("expected %d download attempts, got %d", maxDownloadAttempts, n)
+	}
+	if db.Ready() {
+		t.Error("expected no database to be set up")
+	}
+	if fileExists(filepath.Join(db.dir, CountryDBEdition+".mmdb")) {
+		t.Error("expected no database file to be written")
+	}
+
+	// The partial archive is kept for resuming on the next update check,
+	// along with the checksum it has to end up with
+	archivePath := filepath.Join(db.dir, CountryDBEdition+".tar.gz")
+	if archive, err := os.ReadFile(archivePath); err != nil || string(archive) != "truncated" {
+		t.Errorf("expected the partial archive to be kept, got %q, %v", archive, err)
+	}
+	if checksum, err := os.ReadFile(archivePath + ".md5"); err != nil || string(checksum) != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("expected the checksum the partial archive should have to be kept, got %q, %v", checksum, err)
+	}
+}
+
+func TestLookupDuringDownloadRetry(t *testing.T) {
+	defer func(delay time.Duration) { downloadRetryDelay = delay }(downloadRetryDelay)
+	downloadRetryDelay = time.Minute
+
+	archive, checksum := testArchive(t)
+	var updating atomic.Bool
+	var archiveRequests atomic.Int32
+	db := newDownloadTestDatabase(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChecksumRequest(r) {
+			if updating.Load() {
+				_, _ = io.WriteString(w, "d41d8cd98f00b204e9800998ecf8427e")
+			} else {
+				_, _ = io.WriteString(w, checksum)
+			}
+			return
+		}
+
+		if updating.Load() {
+			archiveRequests.Add(1)
+			w.Header().Set("Content-Length", "1024")
+			_, _ = w.Write([]byte("truncated"))
+			return
+		}
+		_, _ = w.Write(archive)
+	}))
+	if _, err := db.SetupDatabase(1, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The update waits for a minute before resuming the download
+	updating.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	updateDone := make(chan error)
+	go func() {
+		_, err := db.SetupDatabaseContext(ctx, 1, "test")
+		updateDone <- err
+	}()
+	defer func() {
+		cancel()
+		<-updateDone
+	}()
+	for archiveRequests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	lookupDone := make(chan error)
+	go func() {
+		_, err := db.GetRecord(net.ParseIP("1.2.3.4"))
+		lookupDone <- err
+	}()
+	select {
+	case err := <-lookupDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup waited for the update")
+	}
+}
+
+// testArchive packs the test database like MaxMind does, returning the
+// archive and its checksum
+func testArchive(t *testing.T) ([]byte, string) {
+	t.Helper()
+
+	database, err := os.ReadFile(writeTestDatabase(t, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: CountryDBEdition + "_20260101/" + CountryDBEdition + ".mmdb",
+		Mode: 0644,
+		Size: int64(len(database)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(database); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), fmt.Sprintf("%x", md5.Sum(buf.Bytes()))
+}
+
+// mixCase alternates the case of letters in s
+func mixCase(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i := 0; i < len(b); i += 2 {
+		b[i] = strings.ToUpper(string(b[i]))[0]
+	}
+	return string(b)
+}
+
+func TestSetupDatabaseChecksumCase(t *testing.T) {
+	archive, checksum := testArchive(t)
+
+	var archiveRequests atomic.Int32
+	db := newDownloadTestDatabase(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isChecksumRequest(r) {
+			_, _ = fmt.Fprintf(w, "%s  %s.tar.gz\n", strings.ToUpper(checksum), CountryDBEdition)
+			return
+		}
+
+		archiveRequests.Add(1)
+		_, _ = w.Write(archive)
+	}))
+
+	if updated, err := db.SetupDatabase(1, "test"); err != nil {
+		t.Fatal(err)
+	} else if !updated {
+		t.Fatal("expected the database to be downloaded")
+	}
+
+	checksumPath := filepath.Join(db.dir, CountryDBEdition+".mmdb."+DefaultChecksumAlgorithm)
+	if stored, err := os.ReadFile(checksumPath); err != nil {
+		t.Fatal(err)
+	} else if string(stored) != checksum {
+		t.Errorf("expected stored checksum %q, got %q", checksum, stored)
+	}
+
+	// Neither side's casing or whitespace should look like an update
+	if err := os.WriteFile(checksumPath, []byte(mixCase(checksum)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := db.RefreshDatabase(1, "test"); err != nil {
+		t.Fatal(err)
+	} else if updated {
+		t.Error("expected no update to be found")
+	}
+	if n := archiveRequests.Load(); n != 1 {
+		t.Errorf("expected the database to be downloaded once, got %d downloads", n)
+	}
+}
+
+// Walking for the known countries isn't capped, so that the list is never
+// cut short and then cached as if it was complete
+func TestKnownCountries(t *testing.T) {
+	db := newTestDatabase(t)
+	db.MaxIterationNetworks = 1
+
+	_, countries, err := db.KnownCountries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"DE", "EE", "US"}; !slices.Equal(countries, want) {
+		t.Errorf("expected %v, got %v", want, countries)
+	}
+
+	// A new database gets walked again
+	networks := map[string]mmdbtype.Map{"195.50.0.0/16": testCountry("EE", "EU", nil)}
+	if _, err := db.openDatabase(writeTestEditionDatabase(t, t.TempDir(), CountryDBEdition, networks)); err != nil {
+		t.Fatal(err)
+	}
+	if _, countries, err = db.KnownCountries(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"EE"}; !slices.Equal(countries, want) {
+		t.Errorf("expected %v after the update, got %v", want, countries)
+	}
+}
+
+func TestTolerateDecodeErrors(t *testing.T) {
+	// A country which isn't a map doesn't decode into GeoIPRecord
+	db := newTestEditionDatabase(t, CountryDBEdition, map[string]mmdbtype.Map{
+		"1.2.3.0/24": {"country": mmdbtype.String("DE")},
+	})
+	ip := net.ParseIP("1.2.3.4")
+
+	if _, err := db.GetRecord(ip); err == nil {
+		t.Fatal("expected a decode error")
+	}
+	if _, _, err := db.GetRecordNetwork(ip); err == nil {
+		t.Fatal("expected a decode error")
+	}
+
+	db.TolerateDecodeErrors = true
+	if record, err := db.GetRecord(ip); err != nil || record.Country.ISOCode != nil {
+		t.Errorf("expected an empty record, got %+v, %v", record, err)
+	}
+	record, network, err := db.GetRecordNetwork(ip)
+	if err != nil || record.Country.ISOCode != nil {
+		t.Errorf("expected an empty record, got %+v, %v", record, err)
+	}
+	if network == nil || network.String() != "1.2.3.0/24" {
+		t.Errorf("expected the network of the undecodable record, got %v", network)
+	}
+}
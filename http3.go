@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// advertiseHTTP3 announces h3 with an Alt-Svc header on responses that were
+// served over HTTP/1.1 or HTTP/2, so that clients switch over to h3.
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// Fails only until the UDP listener is up
+			_ = h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
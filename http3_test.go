@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	// Borrow the certificate of a TLS test server
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsServer.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handleCountry(newTestEditions(t), "", false, "")
+	h3srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: tlsServer.TLS.Certificates}),
+	}
+	go func() { _ = h3srv.Serve(conn) }()
+	t.Cleanup(func() { _ = h3srv.Close() })
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(func() { _ = transport.Close() })
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + conn.LocalAddr().String() + "/api/v1/country?ip=1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 3 || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 over HTTP/3, got %d over %s", resp.StatusCode, resp.Proto)
+	}
+
+	// The TCP listener points clients at the UDP one
+	rec := httptest.NewRecorder()
+	advertiseHTTP3(h3srv, handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4", nil))
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	if want := `h3=":` + port + `"; ma=2592000`; rec.Header().Get("Alt-Svc") != want {
+		t.Errorf("expected Alt-Svc %q, got %q", want, rec.Header().Get("Alt-Svc"))
+	}
+}
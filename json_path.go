@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+)
+
+const maxJSONPathRequestSize = 64 << 10
+
+// lookupJSONPath walks a decoded JSON document along a dotted path of
+// object keys (e.g. "event.client.ip") and returns the string found there.
+func lookupJSONPath(document interface{}, path string) (string, bool) {
+	current := document
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if current, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+
+	value, ok := current.(string)
+	return value, ok
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultLang is the language of names when none are asked for
+const defaultLang = "en"
+
+// requestLangs returns the languages asked for in the langs query
+// parameter, in order of preference
+func requestLangs(r *http.Request) []string {
+	rawLangs := r.URL.Query().Get("langs")
+	if len(rawLangs) == 0 {
+		return nil
+	}
+
+	var langs []string
+	for _, lang := range strings.Split(rawLangs, ",") {
+		if lang = strings.TrimSpace(lang); len(lang) > 0 {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// localizedNames picks the names in langs, leaving out the ones missing
+// from names
+func localizedNames(names map[string]string, langs []string) map[string]string {
+	localized := make(map[string]string)
+	for _, lang := range langs {
+		if name, ok := names[lang]; ok {
+			localized[lang] = name
+		}
+	}
+	return localized
+}
+
+// preferredName picks the name in the first of langs found in names, or in
+// defaultLang without langs
+func preferredName(names map[string]string, langs []string) (string, bool) {
+	if len(langs) == 0 {
+		langs = []string{defaultLang}
+	}
+	for _, lang := range langs {
+		if name, ok := names[lang]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
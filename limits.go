@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+)
+
+type rateLimitSettings struct {
+	Enabled   bool    `json:"enabled"`
+	PerSecond float64 `json:"per_second,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+type limits struct {
+	MaxBulkIPs           int               `json:"max_bulk_ips"`
+	MaxBulkRequestSize   int               `json:"max_bulk_request_size"`
+	MaxBulkQueryIPs      int               `json:"max_bulk_query_ips"`
+	MaxEnrichRequestSize int               `json:"max_enrich_request_size"`
+	RateLimit            rateLimitSettings `json:"rate_limit"`
+}
+
+// handleLimits tells clients how large requests may be and how often they
+// may be made, so that they can split up batches before sending them
+func handleLimits(rateLimitPerSecond float64, rateBurst int) http.HandlerFunc {
+	response := limits{
+		MaxBulkIPs:           maxBulkIPs,
+		MaxBulkRequestSize:   maxBulkRequestSize,
+		MaxBulkQueryIPs:      maxBulkQueryIPs,
+		MaxEnrichRequestSize: maxEnrichRequestSize,
+	}
+	if rateLimitPerSecond > 0 {
+		response.RateLimit = rateLimitSettings{
+			Enabled:   true,
+			PerSecond: rateLimitPerSecond,
+			Burst:     rateBurst,
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, response)
+	}
+}
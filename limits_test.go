@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	var got limits
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/limits", nil)
+	serveTest(t, handleLimits(0, 0), req, http.StatusOK, &got)
+	if got.MaxBulkIPs != maxBulkIPs || got.MaxBulkRequestSize != maxBulkRequestSize || got.RateLimit.Enabled {
+		t.Errorf("unexpected limits %+v", got)
+	}
+
+	serveTest(t, handleLimits(2.5, 5), req, http.StatusOK, &got)
+	if want := (rateLimitSettings{Enabled: true, PerSecond: 2.5, Burst: 5}); got.RateLimit != want {
+		t.Errorf("expected rate limit %+v, got %+v", want, got.RateLimit)
+	}
+}
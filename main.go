@@ -2,14 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -17,6 +34,28 @@ const (
 	StatusError = "error"
 )
 
+type resolvedIPLocation struct {
+	Latitude       *coordinate `json:"latitude"`
+	Longitude      *coordinate `json:"longitude"`
+	AccuracyRadius *uint32     `json:"accuracy_radius"`
+	TimeZone       *string     `json:"time_zone"`
+}
+
+type resolvedIP struct {
+	IP            string              `json:"ip"`
+	Country       *string             `json:"country"`
+	Continent     *string             `json:"continent,omitempty"`
+	CountryNames  map[string]string   `json:"country_names,omitempty"`
+	CityNames     map[string]string   `json:"city_names,omitempty"`
+	Languages     []string            `json:"languages,omitempty"`
+	AddressFamily *string             `json:"address_family,omitempty"`
+	IPv4Mapped    *bool               `json:"ipv4_mapped,omitempty"`
+	DatabaseAge   *int64              `json:"db_age,omitempty"`
+	Network       *string             `json:"network,omitempty"`
+	PrefixLength  *int                `json:"prefix_len,omitempty"`
+	Location      *resolvedIPLocation `json:"location,omitempty"`
+}
+
 func writeResponse(w http.ResponseWriter, httpStatus int, status string, data interface{}) {
 	w.WriteHeader(httpStatus)
 	_ = json.NewEncoder(w).Encode(struct {
@@ -28,147 +67,915 @@ func writeResponse(w http.ResponseWriter, httpStatus int, status string, data in
 	})
 }
 
+// redact hides secrets from logs while still showing whether they're set
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// redactURL hides the password of u, if there's any
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// readRequestIP reads the IP to look up from a single IP request body,
+// either from the top-level ip field or from ipJSONPath when set. Empty
+// bodies yield io.EOF.
+func readRequestIP(w http.ResponseWriter, r *http.Request, ipJSONPath string, strictJSON bool) (string, error) {
+	if len(ipJSONPath) > 0 {
+		// Arbitrary documents, only the configured path matters
+		var document interface{}
+		body := http.MaxBytesReader(w, r.Body, maxJSONPathRequestSize)
+		if err := json.NewDecoder(body).Decode(&document); err != nil {
+			return "", err
+		}
+
+		rawIP, ok := lookupJSONPath(document, ipJSONPath)
+		if !ok {
+			return "", fmt.Errorf("no ip found at %s", ipJSONPath)
+		}
+		return rawIP, nil
+	}
+
+	var ipRequest struct {
+		IP string `json:"ip"`
+	}
+	body := http.MaxBytesReader(w, r.Body, 2048)
+	decoder := json.NewDecoder(body)
+	if strictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&ipRequest); err != nil {
+		return "", err
+	}
+	if strictJSON {
+		// Anything after the object would otherwise be silently ignored
+		if _, err := decoder.Token(); err != io.EOF {
+			return "", errors.New("unexpected data after request object")
+		}
+	}
+	return ipRequest.IP, nil
+}
+
+// parseRequestIP parses the IP to look up from a single IP request. On
+// failure an error response is written and false is returned.
+func parseRequestIP(w http.ResponseWriter, r *http.Request, ipJSONPath string, strictJSON bool) (string, net.IP, bool) {
+	// Parse the damned address. Content-Type is not looked at, a request
+	// without one (or with any other) is always read as JSON. The query
+	// parameter is only used when there's no body.
+	rawIP := r.URL.Query().Get("ip")
+	if r.Method == http.MethodPost {
+		bodyIP, err := readRequestIP(w, r, ipJSONPath, strictJSON)
+		switch {
+		case err == nil:
+			rawIP = bodyIP
+		case err == io.EOF && len(rawIP) > 0:
+			// Empty body, stick with the query parameter
+		default:
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return "", nil, false
+		}
+	}
+
+	var ip net.IP
+	if len(strings.TrimSpace(rawIP)) == 0 {
+		writeResponse(w, http.StatusBadRequest, StatusError, "empty ip")
+		return "", nil, false
+	} else if ip = net.ParseIP(rawIP); ip == nil {
+		writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse ip")
+		return "", nil, false
+	}
+	return rawIP, ip, true
+}
+
 func main() {
+	logFormat := os.Getenv("GEOSVC_LOG_FORMAT")
+	logLevel := os.Getenv("GEOSVC_LOG_LEVEL")
+	if len(logFormat) == 0 {
+		logFormat = "text"
+	}
+	if len(logLevel) == 0 {
+		logLevel = "info"
+	}
+	if logger, err := newLogger(logFormat, logLevel); err != nil {
+		log.Fatalf("Failed to set up logging: %s", err)
+	} else {
+		slog.SetDefault(logger)
+	}
+
+	// geosvc lookup <ip> does a single lookup and exits instead of serving
+	lookupIP := ""
+	if len(os.Args) == 3 && os.Args[1] == "lookup" {
+		lookupIP = os.Args[2]
+	} else if len(os.Args) > 1 {
+		fatalf("usage: %s [lookup <ip>]", os.Args[0])
+	}
+
 	done := make(chan bool, 1)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
+	// Database downloads in flight are given up on once it's time to exit
+	setupCtx, cancelSetup := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancelSetup()
+
 	// Grab configuration from the environment
 	listenAddress := os.Getenv("GEOSVC_LISTEN_ADDR")
 	databaseDir := os.Getenv("GEOSVC_DATA_DIR")
 	accountIdStr := os.Getenv("GEOSVC_MAXMIND_ACCOUNT_ID")
 	accountId := 0
 	licenseKey := os.Getenv("GEOSVC_MAXMIND_LICENSE_KEY")
+	adminAPIKey := os.Getenv("GEOSVC_ADMIN_API_KEY")
+	apiKeys := parseAPIKeys(os.Getenv("GEOSVC_API_KEYS"))
+	corsOriginsStr := os.Getenv("GEOSVC_CORS_ORIGINS")
+	corsOrigins := parseCORSOrigins(corsOriginsStr)
 	cacheSizeStr := os.Getenv("GEOSVC_CACHE_SIZE")
 	cacheSize := 1024
+	cacheTTLStr := os.Getenv("GEOSVC_CACHE_TTL")
+	cacheTTL := time.Duration(0)
+	cacheTTLJitterStr := os.Getenv("GEOSVC_CACHE_TTL_JITTER")
+	cacheTTLJitter := 0.0
+	tolerateDecodeErrorsStr := os.Getenv("GEOSVC_TOLERATE_DECODE_ERRORS")
+	tolerateDecodeErrors := false
+	cachePersistPath := os.Getenv("GEOSVC_CACHE_PERSIST_PATH")
+	cacheWarmupFile := os.Getenv("GEOSVC_CACHE_WARMUP_FILE")
+	strictJSONStr := os.Getenv("GEOSVC_STRICT_JSON")
+	strictJSON := false
+	ipv6LookupPrefixStr := os.Getenv("GEOSVC_IPV6_LOOKUP_PREFIX")
+	ipv6LookupPrefix := 0
+	downloadDNS := os.Getenv("GEOSVC_DOWNLOAD_DNS")
+	downloadSourceIPStr := os.Getenv("GEOSVC_DOWNLOAD_SOURCE_IP")
+	var downloadSourceIP net.IP
+	downloadProxyStr := os.Getenv("GEOSVC_DOWNLOAD_PROXY")
+	var downloadProxy *url.URL
+	downloadTimeoutStr := os.Getenv("GEOSVC_DOWNLOAD_TIMEOUT")
+	downloadTimeout := 10 * time.Minute
+	streamDownloadStr := os.Getenv("GEOSVC_STREAM_DOWNLOAD")
+	streamDownload := false
+	tlsCertPath := os.Getenv("GEOSVC_TLS_CERT")
+	tlsKeyPath := os.Getenv("GEOSVC_TLS_KEY")
+	http3Address := os.Getenv("GEOSVC_HTTP3_ADDR")
+	accessLogStr := os.Getenv("GEOSVC_ACCESS_LOG")
+	accessLogEnabled := false
+	updateIntervalStr := os.Getenv("GEOSVC_UPDATE_INTERVAL")
+	updateInterval := 2 * 24 * time.Hour
+	databaseFileName := os.Getenv("GEOSVC_DB_FILENAME")
+	slowLogThresholdStr := os.Getenv("GEOSVC_SLOW_LOG_THRESHOLD")
+	slowLogThreshold := time.Duration(0)
+	lookupTimeoutStr := os.Getenv("GEOSVC_LOOKUP_TIMEOUT")
+	lookupTimeout := time.Duration(0)
+	statsdAddr := os.Getenv("GEOSVC_STATSD_ADDR")
+	statsdIntervalStr := os.Getenv("GEOSVC_STATSD_INTERVAL")
+	statsdInterval := 10 * time.Second
+	maxLookupGoroutinesStr := os.Getenv("GEOSVC_MAX_LOOKUP_GOROUTINES")
+	maxLookupGoroutines := 0
+	ipv6Policy := os.Getenv("GEOSVC_IPV6_POLICY")
+	updateWebhook := os.Getenv("GEOSVC_UPDATE_WEBHOOK")
+	ipJSONPath := os.Getenv("GEOSVC_IP_JSON_PATH")
+	checksumCacheTTLStr := os.Getenv("GEOSVC_CHECKSUM_CACHE_TTL")
+	checksumCacheTTL := 1 * time.Minute
+	checksumAlgorithm := os.Getenv("GEOSVC_CHECKSUM_ALGO")
+	localDatabasePath := os.Getenv("GEOSVC_LOCAL_DB_PATH")
+	responseCacheControl := os.Getenv("GEOSVC_RESPONSE_CACHE_CONTROL")
+	databaseEditionsStr := os.Getenv("GEOSVC_DB_EDITION")
+	databaseEditions := []string{CountryDBEdition}
+	var localDatabasePaths []string
+	asnDatabaseStr := os.Getenv("GEOSVC_ASN_DB")
+	asnDatabase := false
+	localASNDatabasePath := os.Getenv("GEOSVC_LOCAL_ASN_DB_PATH")
+	watchDatabaseFilesStr := os.Getenv("GEOSVC_WATCH_DB_FILE")
+	watchDatabaseFiles := false
+	maxIterationNetworksStr := os.Getenv("GEOSVC_MAX_ITERATION_NETWORKS")
+	maxIterationNetworks := 1 << 16
+	trustedProxiesStr := os.Getenv("GEOSVC_TRUSTED_PROXIES")
+	var trustedProxies []netip.Prefix
+	rateLimitStr := os.Getenv("GEOSVC_RATE_LIMIT")
+	rateLimitPerSecond := 0.0
+	rateBurstStr := os.Getenv("GEOSVC_RATE_BURST")
+	rateBurst := 0
 	if len(listenAddress) == 0 {
 		listenAddress = "0.0.0.0:5000"
 	}
 	if len(databaseDir) == 0 {
 		databaseDir = "./data"
 	}
-	if len(accountIdStr) == 0 {
-		log.Fatalf("GEOSVC_MAXMIND_ACCOUNT_ID is not set for database downloading and update checks")
-	} else {
+	if len(watchDatabaseFilesStr) > 0 {
+		if v, err := strconv.ParseBool(watchDatabaseFilesStr); err != nil {
+			fatalf("Failed to parse GEOSVC_WATCH_DB_FILE: %s", err)
+		} else {
+			watchDatabaseFiles = v
+		}
+	}
+	if len(accountIdStr) == 0 && len(localDatabasePath) == 0 && !watchDatabaseFiles {
+		fatalf("GEOSVC_MAXMIND_ACCOUNT_ID is not set for database downloading and update checks")
+	} else if len(accountIdStr) > 0 {
 		if v, err := strconv.ParseInt(accountIdStr, 10, 32); err != nil {
-			log.Fatalf("Failed to parse GEOSVC_MAXMIND_ACCOUNT_ID: %s", err)
+			fatalf("Failed to parse GEOSVC_MAXMIND_ACCOUNT_ID: %s", err)
 		} else {
 			accountId = int(v)
 		}
 	}
-	if len(licenseKey) == 0 {
-		log.Fatalf("GEOSVC_MAXMIND_LICENSE_KEY is not set for database downloading and update checks")
+	if len(licenseKey) == 0 && len(localDatabasePath) == 0 && !watchDatabaseFiles {
+		fatalf("GEOSVC_MAXMIND_LICENSE_KEY is not set for database downloading and update checks")
 	}
 	if len(cacheSizeStr) > 0 {
 		if v, err := strconv.ParseInt(cacheSizeStr, 10, 32); err != nil {
-			log.Fatalf("Failed to parse GEOSVC_CACHE_SIZE: %s", err)
+			fatalf("Failed to parse GEOSVC_CACHE_SIZE: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_CACHE_SIZE must not be negative")
 		} else {
 			cacheSize = int(v)
 		}
 	}
+	if len(cacheTTLStr) > 0 {
+		if v, err := time.ParseDuration(cacheTTLStr); err != nil {
+			fatalf("Failed to parse GEOSVC_CACHE_TTL: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_CACHE_TTL must not be negative")
+		} else {
+			cacheTTL = v
+		}
+	}
+	if len(cacheTTLJitterStr) > 0 {
+		if v, err := strconv.ParseFloat(cacheTTLJitterStr, 64); err != nil {
+			fatalf("Failed to parse GEOSVC_CACHE_TTL_JITTER: %s", err)
+		} else if v < 0 || v >= 1 {
+			fatalf("GEOSVC_CACHE_TTL_JITTER must be at least 0 and less than 1")
+		} else {
+			cacheTTLJitter = v
+		}
+	}
+	if len(tolerateDecodeErrorsStr) > 0 {
+		if v, err := strconv.ParseBool(tolerateDecodeErrorsStr); err != nil {
+			fatalf("Failed to parse GEOSVC_TOLERATE_DECODE_ERRORS: %s", err)
+		} else {
+			tolerateDecodeErrors = v
+		}
+	}
+	if len(strictJSONStr) > 0 {
+		if v, err := strconv.ParseBool(strictJSONStr); err != nil {
+			fatalf("Failed to parse GEOSVC_STRICT_JSON: %s", err)
+		} else {
+			strictJSON = v
+		}
+	}
+	if len(ipv6LookupPrefixStr) > 0 {
+		if v, err := strconv.ParseInt(ipv6LookupPrefixStr, 10, 32); err != nil {
+			fatalf("Failed to parse GEOSVC_IPV6_LOOKUP_PREFIX: %s", err)
+		} else if v < 0 || v > 128 {
+			fatalf("GEOSVC_IPV6_LOOKUP_PREFIX must be between 0 and 128")
+		} else {
+			ipv6LookupPrefix = int(v)
+		}
+	}
+	if len(slowLogThresholdStr) > 0 {
+		if v, err := time.ParseDuration(slowLogThresholdStr); err != nil {
+			fatalf("Failed to parse GEOSVC_SLOW_LOG_THRESHOLD: %s", err)
+		} else {
+			slowLogThreshold = v
+		}
+	}
+	if len(lookupTimeoutStr) > 0 {
+		if v, err := time.ParseDuration(lookupTimeoutStr); err != nil {
+			fatalf("Failed to parse GEOSVC_LOOKUP_TIMEOUT: %s", err)
+		} else {
+			lookupTimeout = v
+		}
+	}
+	if len(statsdIntervalStr) > 0 {
+		if v, err := time.ParseDuration(statsdIntervalStr); err != nil {
+			fatalf("Failed to parse GEOSVC_STATSD_INTERVAL: %s", err)
+		} else if v <= 0 {
+			fatalf("GEOSVC_STATSD_INTERVAL must be positive")
+		} else {
+			statsdInterval = v
+		}
+	}
+	if len(maxLookupGoroutinesStr) > 0 {
+		if v, err := strconv.ParseInt(maxLookupGoroutinesStr, 10, 32); err != nil {
+			fatalf("Failed to parse GEOSVC_MAX_LOOKUP_GOROUTINES: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_MAX_LOOKUP_GOROUTINES must not be negative")
+		} else {
+			maxLookupGoroutines = int(v)
+		}
+	}
+	if len(checksumCacheTTLStr) > 0 {
+		if v, err := time.ParseDuration(checksumCacheTTLStr); err != nil {
+			fatalf("Failed to parse GEOSVC_CHECKSUM_CACHE_TTL: %s", err)
+		} else {
+			checksumCacheTTL = v
+		}
+	}
+	if len(checksumAlgorithm) == 0 {
+		checksumAlgorithm = DefaultChecksumAlgorithm
+	} else if _, ok := ChecksumAlgorithms[checksumAlgorithm]; !ok {
+		fatalf("GEOSVC_CHECKSUM_ALGO must be either md5 or sha256")
+	}
+	if len(maxIterationNetworksStr) > 0 {
+		if v, err := strconv.ParseInt(maxIterationNetworksStr, 10, 32); err != nil {
+			fatalf("Failed to parse GEOSVC_MAX_ITERATION_NETWORKS: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_MAX_ITERATION_NETWORKS must not be negative")
+		} else {
+			maxIterationNetworks = int(v)
+		}
+	}
+	if len(trustedProxiesStr) > 0 {
+		if v, err := parseTrustedProxies(trustedProxiesStr); err != nil {
+			fatalf("Failed to parse GEOSVC_TRUSTED_PROXIES: %s", err)
+		} else {
+			trustedProxies = v
+		}
+	}
+	if len(rateLimitStr) > 0 {
+		if v, err := strconv.ParseFloat(rateLimitStr, 64); err != nil {
+			fatalf("Failed to parse GEOSVC_RATE_LIMIT: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_RATE_LIMIT must not be negative")
+		} else {
+			rateLimitPerSecond = v
+		}
+	}
+	if len(rateBurstStr) > 0 {
+		if v, err := strconv.ParseInt(rateBurstStr, 10, 32); err != nil {
+			fatalf("Failed to parse GEOSVC_RATE_BURST: %s", err)
+		} else if v < 1 {
+			fatalf("GEOSVC_RATE_BURST must be at least 1")
+		} else {
+			rateBurst = int(v)
+		}
+	} else {
+		// Allow at least a second worth of requests at once
+		rateBurst = max(1, int(math.Ceil(rateLimitPerSecond)))
+	}
+	if len(ipv6Policy) == 0 {
+		ipv6Policy = "reject"
+	} else if ipv6Policy != "reject" && ipv6Policy != "best-effort" {
+		fatalf("GEOSVC_IPV6_POLICY must be either reject or best-effort")
+	}
+	if len(asnDatabaseStr) > 0 {
+		if v, err := strconv.ParseBool(asnDatabaseStr); err != nil {
+			fatalf("Failed to parse GEOSVC_ASN_DB: %s", err)
+		} else {
+			asnDatabase = v
+		}
+	}
+	if asnDatabase && len(localDatabasePath) > 0 && len(localASNDatabasePath) == 0 {
+		fatalf("GEOSVC_LOCAL_ASN_DB_PATH must be set along with GEOSVC_LOCAL_DB_PATH when GEOSVC_ASN_DB is enabled")
+	}
+	if len(databaseEditionsStr) > 0 {
+		databaseEditions = nil
+		seen := make(map[string]bool)
+		for _, edition := range strings.Split(databaseEditionsStr, ",") {
+			edition = strings.TrimSpace(edition)
+			if edition != CountryDBEdition && edition != CityDBEdition {
+				fatalf("GEOSVC_DB_EDITION must be a list of %s and/or %s", CountryDBEdition, CityDBEdition)
+			} else if seen[edition] {
+				fatalf("GEOSVC_DB_EDITION lists %s more than once", edition)
+			}
+			seen[edition] = true
+			databaseEditions = append(databaseEditions, edition)
+		}
+	}
+	if len(databaseFileName) == 0 && len(databaseEditions) == 1 {
+		databaseFileName = databaseEditions[0] + ".mmdb"
+	} else if len(databaseFileName) > 0 && len(databaseEditions) > 1 {
+		fatalf("GEOSVC_DB_FILENAME can't be used with more than one edition")
+	} else if len(databaseFileName) > 0 && filepath.Base(databaseFileName) != databaseFileName {
+		fatalf("GEOSVC_DB_FILENAME must be a file name, not a path")
+	}
+	if len(localDatabasePath) > 0 {
+		localDatabasePaths = strings.Split(localDatabasePath, ",")
+		if len(localDatabasePaths) != len(databaseEditions) {
+			fatalf("GEOSVC_LOCAL_DB_PATH must list one path per edition in GEOSVC_DB_EDITION")
+		}
+	}
+	if len(downloadSourceIPStr) > 0 {
+		if downloadSourceIP = net.ParseIP(downloadSourceIPStr); downloadSourceIP == nil {
+			fatalf("Failed to parse GEOSVC_DOWNLOAD_SOURCE_IP: %s", downloadSourceIPStr)
+		}
+	}
+	if len(downloadDNS) > 0 {
+		if _, _, err := net.SplitHostPort(downloadDNS); err != nil {
+			downloadDNS = net.JoinHostPort(downloadDNS, "53")
+		}
+	}
+	if len(downloadProxyStr) > 0 {
+		if v, err := url.Parse(downloadProxyStr); err != nil {
+			fatalf("Failed to parse GEOSVC_DOWNLOAD_PROXY: %s", err)
+		} else if len(v.Scheme) == 0 || len(v.Host) == 0 {
+			fatalf("GEOSVC_DOWNLOAD_PROXY must be an absolute URL, e.g. http://proxy:3128")
+		} else {
+			downloadProxy = v
+		}
+	}
+	if len(downloadTimeoutStr) > 0 {
+		if v, err := time.ParseDuration(downloadTimeoutStr); err != nil {
+			fatalf("Failed to parse GEOSVC_DOWNLOAD_TIMEOUT: %s", err)
+		} else {
+			downloadTimeout = v
+		}
+	}
+	if len(streamDownloadStr) > 0 {
+		if v, err := strconv.ParseBool(streamDownloadStr); err != nil {
+			fatalf("Failed to parse GEOSVC_STREAM_DOWNLOAD: %s", err)
+		} else {
+			streamDownload = v
+		}
+	}
+	if (len(tlsCertPath) > 0) != (len(tlsKeyPath) > 0) {
+		fatalf("GEOSVC_TLS_CERT and GEOSVC_TLS_KEY must be set together")
+	}
+	if len(http3Address) > 0 && len(tlsCertPath) == 0 {
+		fatalf("GEOSVC_HTTP3_ADDR requires GEOSVC_TLS_CERT and GEOSVC_TLS_KEY")
+	}
+	if len(accessLogStr) > 0 {
+		if v, err := strconv.ParseBool(accessLogStr); err != nil {
+			fatalf("Failed to parse GEOSVC_ACCESS_LOG: %s", err)
+		} else {
+			accessLogEnabled = v
+		}
+	}
+	if updateIntervalStr == "off" {
+		updateInterval = 0
+	} else if len(updateIntervalStr) > 0 {
+		if v, err := time.ParseDuration(updateIntervalStr); err != nil {
+			fatalf("Failed to parse GEOSVC_UPDATE_INTERVAL: %s", err)
+		} else if v < 0 {
+			fatalf("GEOSVC_UPDATE_INTERVAL must not be negative")
+		} else {
+			updateInterval = v
+		}
+	}
+
+	slog.Info(
+		"effective configuration",
+		"listen_addr", listenAddress,
+		"data_dir", databaseDir,
+		"maxmind_account_id", accountId,
+		"maxmind_license_key", redact(licenseKey),
+		"cache_size", cacheSize,
+		"cache_ttl", cacheTTL.String(),
+		"cache_ttl_jitter", cacheTTLJitter,
+		"cache_persist_path", cachePersistPath,
+		"cache_warmup_file", cacheWarmupFile,
+		"tolerate_decode_errors", tolerateDecodeErrors,
+		"strict_json", strictJSON,
+		"ipv6_lookup_prefix", ipv6LookupPrefix,
+		"update_interval", updateInterval.String(),
+		"download_dns", downloadDNS,
+		"download_source_ip", downloadSourceIPStr,
+		"download_proxy", redactURL(downloadProxy),
+		"download_timeout", downloadTimeout.String(),
+		"stream_download", streamDownload,
+		"db_filename", databaseFileName,
+		"slow_log_threshold", slowLogThreshold.String(),
+		"lookup_timeout", lookupTimeout.String(),
+		"max_lookup_goroutines", maxLookupGoroutines,
+		"statsd_addr", statsdAddr,
+		"statsd_interval", statsdInterval.String(),
+		"ipv6_policy", ipv6Policy,
+		"update_webhook", redact(updateWebhook),
+		"ip_json_path", ipJSONPath,
+		"checksum_cache_ttl", checksumCacheTTL.String(),
+		"checksum_algo", checksumAlgorithm,
+		"local_db_path", localDatabasePath,
+		"response_cache_control", responseCacheControl,
+		"db_edition", strings.Join(databaseEditions, ","),
+		"asn_db", asnDatabase,
+		"local_asn_db_path", localASNDatabasePath,
+		"watch_db_file", watchDatabaseFiles,
+		"max_iteration_networks", maxIterationNetworks,
+		"trusted_proxies", trustedProxiesStr,
+		"rate_limit", rateLimitPerSecond,
+		"rate_burst", rateBurst,
+		"admin_api_key", redact(adminAPIKey),
+		"api_keys", len(apiKeys),
+		"cors_origins", corsOriginsStr,
+		"log_format", logFormat,
+		"log_level", logLevel,
+		"access_log", accessLogEnabled,
+		"tls_cert", tlsCertPath,
+		"tls_key", tlsKeyPath,
+		"http3_addr", http3Address,
+	)
 
 	// Create database directory
 	if err := os.MkdirAll(databaseDir, 0755); err != nil {
 		log.Panicf("failed to create %s: %s", databaseDir, err)
 	}
 
-	db := NewGeoIPDatabase(databaseDir, cacheSize)
-	if err := db.SetupDatabase(accountId, licenseKey); err != nil {
-		log.Fatalf("failed to set up geoip database: %s", err)
+	downloadClient := newDownloadClient(downloadDNS, downloadSourceIP, downloadProxy, downloadTimeout)
+	newDatabase := func(edition string) *GeoIPDatabase {
+		d := NewGeoIPDatabase(databaseDir, cacheSize)
+		d.Edition = edition
+		d.TolerateDecodeErrors = tolerateDecodeErrors
+		d.IPv6LookupPrefix = ipv6LookupPrefix
+		d.BestEffortIPv6 = ipv6Policy == "best-effort"
+		d.SlowLookupThreshold = slowLogThreshold
+		d.UpdateWebhook = updateWebhook
+		d.HTTPClient = downloadClient
+		d.ChecksumCacheTTL = checksumCacheTTL
+		d.ChecksumAlgorithm = checksumAlgorithm
+		d.StreamDownload = streamDownload
+		d.MaxIterationNetworks = maxIterationNetworks
+		d.CacheTTL = cacheTTL
+		d.CacheTTLJitter = cacheTTLJitter
+		return d
 	}
-	defer func() { _ = db.Close() }()
 
-	// Set up automatic database updater
-	updateTicker := time.NewTicker(2 * 24 * time.Hour)
-	go func() {
-		for {
-			select {
-			case <-done:
-				break
-			case <-updateTicker.C:
-				log.Print("checking for GeoIP database updates")
-				if err := db.SetupDatabase(accountId, licenseKey); err != nil {
-					log.Printf("failed pull geoip database update: %s", err)
-				}
+	dbs := &editionDatabases{
+		databases:      make(map[string]*GeoIPDatabase),
+		defaultEdition: databaseEditions[0],
+	}
+	var databases []*GeoIPDatabase
+	for i, edition := range databaseEditions {
+		d := newDatabase(edition)
+		d.DatabaseFileName = databaseFileName
+		if len(localDatabasePaths) > 0 {
+			d.LocalDatabasePath = strings.TrimSpace(localDatabasePaths[i])
+		} else if watchDatabaseFiles {
+			// Someone else keeps the file in the data directory up to date
+			d.LocalDatabasePath = filepath.Join(databaseDir, d.databaseFileName())
+		}
+		defer func() { _ = d.Close() }()
+		dbs.databases[edition] = d
+		databases = append(databases, d)
+	}
+	db := dbs.defaultDatabase()
+
+	if len(lookupIP) > 0 {
+		for _, d := range databases {
+			if _, err := d.SetupDatabaseContext(setupCtx, accountId, licenseKey); err != nil {
+				fatalf("failed to set up %s database: %s", d.edition(), err)
 			}
 		}
-	}()
+		if err := runLookup(db, lookupIP); err != nil {
+			fatalf("failed to look up %s: %s", lookupIP, err)
+		}
+		return
+	}
+
+	var asnDB *GeoIPDatabase
+	if asnDatabase {
+		asnDB = newDatabase(ASNDBEdition)
+		asnDB.LocalDatabasePath = localASNDatabasePath
+		if len(asnDB.LocalDatabasePath) == 0 && watchDatabaseFiles {
+			asnDB.LocalDatabasePath = filepath.Join(databaseDir, asnDB.databaseFileName())
+		}
+		defer func() { _ = asnDB.Close() }()
+		databases = append(databases, asnDB)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/country", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/country", handleCountry(dbs, ipJSONPath, strictJSON, responseCacheControl))
+
+	mux.HandleFunc("/api/v1/city", handleCity(dbs, ipJSONPath, strictJSON, responseCacheControl))
+	mux.HandleFunc("/api/v1/asn", handleASN(asnDB, ipJSONPath, strictJSON, responseCacheControl))
+	mux.HandleFunc("/api/v1/asn/{number}/networks", handleASNNetworks(asnDB))
+	mux.HandleFunc("/api/v1/self", handleSelf(dbs, trustedProxies))
+	mux.HandleFunc("/api/v1/network", handleNetwork(dbs, strictJSON))
+	mux.HandleFunc("/api/v1/subnet", handleSubnet(dbs, strictJSON))
+	mux.HandleFunc("/api/v1/range", handleRange(dbs, strictJSON))
+	mux.HandleFunc("/api/v1/enrich", handleEnrich(dbs))
+	slots := newLookupSlots(maxLookupGoroutines)
+	mux.HandleFunc("/api/v1/bulkcheck", handleBulkCheck(dbs, strictJSON, lookupTimeout, slots))
+	mux.HandleFunc("/api/v1/bulkcountry", handleBulkCountry(dbs, strictJSON, lookupTimeout, slots))
+	mux.HandleFunc("/api/v1/aggregate", handleAggregate(dbs, asnDB, strictJSON, lookupTimeout, slots))
+
+	mux.HandleFunc("/api/v1/dbinfo", handleDBInfo(dbs))
+	mux.HandleFunc("/api/v1/cachestats", handleCacheStats(dbs))
+	mux.HandleFunc("/api/v1/limits", handleLimits(rateLimitPerSecond, rateBurst))
+	mux.HandleFunc("/api/v1/known-countries", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		if r.Method != http.MethodPost {
+		if r.Method != http.MethodGet {
 			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
 			return
 		}
 
-		// Parse the damned address
-		var ipRequest struct {
-			IP string `json:"ip"`
-		}
-		body := http.MaxBytesReader(w, r.Body, 2048)
-		if err := json.NewDecoder(body).Decode(&ipRequest); err != nil {
-			writeResponse(w, http.StatusBadRequest, StatusError, err)
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
 			return
 		}
 
-		var ip net.IP
-		if ip = net.ParseIP(ipRequest.IP); ip == nil {
-			writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse ip")
+		buildEpoch, countries, err := db.KnownCountries(r.Context())
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
 			return
 		}
-		normalizedIP := ip.String()
 
-		// Lookup
-		country, err := db.GetCountryISOCode(ip)
-		if err != nil {
-			writeResponse(w, http.StatusInternalServerError, StatusError, err)
+		if len(responseCacheControl) > 0 {
+			w.Header().Set("Cache-Control", responseCacheControl)
+		}
+		writeResponse(w, http.StatusOK, StatusOK, struct {
+			BuildEpoch uint     `json:"build_epoch"`
+			Countries  []string `json:"countries"`
+		}{
+			BuildEpoch: buildEpoch,
+			Countries:  countries,
+		})
+	})
+
+	mux.HandleFunc("/admin/update", requireAdminKey(adminAPIKey, handleAdminUpdate(setupCtx, databases, accountId, licenseKey)))
+	mux.HandleFunc("/admin/client-ip", requireAdminKey(adminAPIKey, handleClientIPDryRun(dbs, trustedProxies, strictJSON)))
+	mux.HandleFunc("/admin/cache", requireAdminKey(adminAPIKey, handleAdminCache(dbs)))
+	mux.HandleFunc("/admin/cachestats/reset", requireAdminKey(adminAPIKey, handleAdminCacheStatsReset(dbs)))
+	var draining atomic.Bool
+	mux.HandleFunc("/admin/drain", requireAdminKey(adminAPIKey, handleAdminDrain(&draining)))
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Liveness only, doesn't touch the database so that a long update can't
+	// fail it. Draining fails it on purpose.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
 			return
 		}
+		if draining.Load() {
+			writeResponse(w, http.StatusServiceUnavailable, StatusError, "draining")
+			return
+		}
+
+		// Editions whose updates are on hold because of the download
+		// server's rate limits, and until when
+		backoff := make(map[string]time.Time)
+		for _, d := range databases {
+			if until, ok := d.RateLimitedUntil(); ok {
+				backoff[d.edition()] = until.UTC().Truncate(time.Second)
+			}
+		}
 
 		writeResponse(w, http.StatusOK, StatusOK, struct {
-			IP      string  `json:"ip"`
-			Country *string `json:"country"`
+			UpdateBackoff map[string]time.Time `json:"update_backoff"`
 		}{
-			IP:      normalizedIP,
-			Country: country,
+			UpdateBackoff: backoff,
 		})
 	})
 
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		if draining.Load() {
+			writeResponse(w, http.StatusServiceUnavailable, StatusError, "draining")
+			return
+		}
+
+		ready := true
+		for _, d := range databases {
+			ready = ready && d.Ready()
+		}
+		if !ready {
+			writeResponse(w, http.StatusServiceUnavailable, StatusError, "database not loaded")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, nil)
+	})
+
+	var limiter *rateLimiter
+	if rateLimitPerSecond > 0 {
+		limiter = newRateLimiter(rate.Limit(rateLimitPerSecond), rateBurst)
+		go limiter.evictIdle()
+	}
+
+	var setUp atomic.Bool
+	var handler http.Handler = gzipResponses(mux)
+	handler = serveWhenSetUp(&setUp, handler)
+	handler = rejectWhenDraining(&draining, handler)
+	handler = requireAPIKey(apiKeys, handler)
+	handler = rateLimit(limiter, trustedProxies, handler)
+	handler = cors(corsOrigins, handler)
+	if accessLogEnabled {
+		handler = accessLog(handler)
+	}
+
 	srv := &http.Server{
-		Handler:      mux,
+		Handler:      handler,
 		Addr:         listenAddress,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
 
-	log.Printf("serving http on http://%s", listenAddress)
-	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Printf("failed to serve http: %s", err)
-			done <- true
+	var h3srv *http3.Server
+	if len(tlsCertPath) > 0 {
+		certificates, err := newCertificateReloader(tlsCertPath, tlsKeyPath)
+		if err != nil {
+			fatalf("failed to load tls certificate: %s", err)
 		}
-	}()
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certificates.GetCertificate,
+		}
+
+		// SIGHUP reloads the certificate right away
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certificates.Reload(); err != nil {
+					slog.Error("failed to reload tls certificate, keeping the previous one", "cert", tlsCertPath, "key", tlsKeyPath, "error", err)
+				}
+			}
+		}()
+
+		// Same handler and certificate over QUIC, advertised on the TCP listener
+		if len(http3Address) > 0 {
+			h3srv = &http3.Server{
+				Handler:   handler,
+				Addr:      http3Address,
+				TLSConfig: http3.ConfigureTLSConfig(srv.TLSConfig),
+			}
+			srv.Handler = advertiseHTTP3(h3srv, handler)
+
+			slog.Info("serving http3", "addr", http3Address)
+			go func() {
+				if err := h3srv.ListenAndServe(); err != http.ErrServerClosed {
+					slog.Error("failed to serve http3", "addr", http3Address, "error", err)
+					done <- true
+				}
+			}()
+		}
+
+		slog.Info("serving https", "addr", listenAddress)
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				slog.Error("failed to serve https", "addr", listenAddress, "error", err)
+				done <- true
+			}
+		}()
+	} else {
+		slog.Info("serving http", "addr", listenAddress)
+		go func() {
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				slog.Error("failed to serve http", "addr", listenAddress, "error", err)
+				done <- true
+			}
+		}()
+	}
+
+	// Probes can tell a starting instance apart from a dead one while the
+	// databases are being downloaded
+	for _, d := range databases {
+		if _, err := d.SetupDatabaseContext(setupCtx, accountId, licenseKey); err != nil {
+			fatalf("failed to set up %s database: %s", d.edition(), err)
+		}
+	}
+	setUp.Store(true)
+
+	if len(cachePersistPath) > 0 {
+		if n, err := db.LoadCache(cachePersistPath); err != nil {
+			slog.Error("failed to load persisted cache", "path", cachePersistPath, "error", err)
+		} else {
+			slog.Info("loaded persisted cache", "path", cachePersistPath, "entries", n)
+		}
+	}
+
+	// Warming up happens while already serving, it only saves lookups
+	if len(cacheWarmupFile) > 0 {
+		go warmCache(db, cacheWarmupFile)
+	}
+
+	// Set up automatic database updaters, one per database so that a
+	// failing update doesn't hold up the others
+	var updateTickers []*time.Ticker
+	if updateInterval == 0 {
+		slog.Info("automatic database updates are disabled")
+	}
+	for _, d := range databases {
+		if updateInterval == 0 || len(d.LocalDatabasePath) > 0 {
+			// Nothing to update from, or the database is managed by someone else
+			continue
+		}
+		updateTicker := time.NewTicker(updateInterval)
+		updateTickers = append(updateTickers, updateTicker)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					break
+				case <-updateTicker.C:
+					slog.Info("checking for database updates", "edition", d.edition())
+					var rateLimitErr *RateLimitError
+					if _, err := d.SetupDatabaseContext(setupCtx, accountId, licenseKey); errors.As(err, &rateLimitErr) {
+						// Retry once MaxMind lets us, instead of waiting for the next regular update
+						slog.Error("failed to pull database update", "edition", d.edition(), "error", err, "retry_after", rateLimitErr.RetryAfter.String())
+						updateTicker.Reset(rateLimitErr.RetryAfter)
+						continue
+					} else if err != nil {
+						slog.Error("failed to pull database update", "edition", d.edition(), "error", err)
+					}
+					updateTicker.Reset(updateInterval)
+				}
+			}
+		}()
+	}
+
+	// Expired cache entries are already ignored, but would otherwise linger
+	// until evicted
+	var expiryTicker *time.Ticker
+	if cacheTTL > 0 {
+		expiryTicker = time.NewTicker(cacheTTL)
+		go func() {
+			for range expiryTicker.C {
+				for _, d := range databases {
+					if n := d.ExpireCache(); n > 0 {
+						slog.Debug("expired cached lookups", "edition", d.edition(), "entries", n)
+					}
+				}
+			}
+		}()
+	}
+
+	// Mirror the Prometheus metrics to statsd
+	var statsd *statsdEmitter
+	var statsdTicker *time.Ticker
+	if len(statsdAddr) > 0 {
+		var err error
+		if statsd, err = newStatsdEmitter(statsdAddr, prometheus.DefaultGatherer); err != nil {
+			fatalf("failed to set up statsd: %s", err)
+		}
+		defer func() { _ = statsd.Close() }()
+
+		statsdTicker = time.NewTicker(statsdInterval)
+		go func() {
+			for range statsdTicker.C {
+				if err := statsd.emit(); err != nil {
+					slog.Warn("failed to emit statsd metrics", "addr", statsdAddr, "error", err)
+				}
+			}
+		}()
+	}
+
+	if watchDatabaseFiles {
+		for _, d := range databases {
+			watcher, err := watchDatabaseFile(d.LocalDatabasePath, func() error {
+				_, err := d.SetupDatabase(accountId, licenseKey)
+				return err
+			})
+			if err != nil {
+				fatalf("failed to watch %s: %s", d.LocalDatabasePath, err)
+			}
+			defer func() { _ = watcher.Close() }()
+		}
+	}
 
 	// Wait for a signal or exit flag
 	select {
 	case <-sig:
-		log.Print("caught signal, exiting")
+		slog.Info("caught signal, exiting")
 	case <-done:
 		// no-op
 	}
 
-	updateTicker.Stop()
+	cancelSetup()
+	for _, updateTicker := range updateTickers {
+		updateTicker.Stop()
+	}
+	if expiryTicker != nil {
+		expiryTicker.Stop()
+	}
 
 	// It's time to go
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("failed to shut down http server: %s", err)
+		slog.Error("failed to shut down http server", "error", err)
 	}
 
 	if err := srv.Close(); err != nil {
-		log.Printf("failed to close http server: %s", err)
+		slog.Error("failed to close http server", "error", err)
+	}
+
+	if h3srv != nil {
+		if err := h3srv.Shutdown(ctx); err != nil {
+			slog.Error("failed to shut down http3 server", "error", err)
+		}
+	}
+
+	// Whatever was counted since the last emit
+	if statsd != nil {
+		statsdTicker.Stop()
+		if err := statsd.emit(); err != nil {
+			slog.Warn("failed to emit statsd metrics", "addr", statsdAddr, "error", err)
+		}
+	}
+
+	if len(cachePersistPath) > 0 {
+		if err := db.SaveCache(cachePersistPath); err != nil {
+			slog.Error("failed to persist cache", "path", cachePersistPath, "error", err)
+		}
 	}
 }
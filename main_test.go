@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestEditions serves the test database as the only edition
+func newTestEditions(t testing.TB) *editionDatabases {
+	t.Helper()
+
+	return &editionDatabases{
+		databases:      map[string]*GeoIPDatabase{CountryDBEdition: newTestDatabase(t)},
+		defaultEdition: CountryDBEdition,
+	}
+}
+
+// newTestCityEditions is newTestEditions with a City edition configured
+// next to the default Country one
+func newTestCityEditions(t testing.TB) *editionDatabases {
+	t.Helper()
+
+	dbs := newTestEditions(t)
+	dbs.databases[CityDBEdition] = newTestEditionDatabase(t, CityDBEdition, testCityDatabaseNetworks)
+	return dbs
+}
+
+// serveTest runs a single request through handler, checks the status and
+// decodes the "data" of the response into data.
+func serveTest(t *testing.T, handler http.Handler, req *http.Request, wantStatus int, data interface{}) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != wantStatus {
+		t.Fatalf("expected status %d, got %d: %s", wantStatus, rec.Code, rec.Body.String())
+	}
+
+	var response struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response %q: %s", rec.Body.String(), err)
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		t.Fatalf("failed to decode response data %q: %s", response.Data, err)
+	}
+}
+
+func TestCountryWithoutContentType(t *testing.T) {
+	handler := handleCountry(newTestEditions(t), "", false, "")
+
+	// As sent by an HTTP/1.0 client which doesn't bother with headers
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/country", strings.NewReader(`{"ip":"1.2.3.4"}`))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	req.Header.Del("Content-Type")
+
+	var resolved resolvedIP
+	serveTest(t, handler, req, http.StatusOK, &resolved)
+	if resolved.IP != "1.2.3.4" {
+		t.Errorf("expected ip 1.2.3.4, got %q", resolved.IP)
+	}
+	if resolved.Country == nil || *resolved.Country != "DE" {
+		t.Errorf("expected country DE, got %v", resolved.Country)
+	}
+}
+
+// The cache holds records with all names, languages are picked when
+// rendering, so different languages for the same IP share a cache entry
+func TestCountryNamesSharedCache(t *testing.T) {
+	dbs := newTestEditions(t)
+	handler := handleCountry(dbs, "", false, "")
+
+	for _, want := range []struct {
+		lang string
+		name string
+	}{
+		{"en", "Germany"},
+		{"de", "Deutschland"},
+		{"en", "Germany"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4&langs="+want.lang, nil)
+		var resolved resolvedIP
+		serveTest(t, handler, req, http.StatusOK, &resolved)
+		if len(resolved.CountryNames) != 1 || resolved.CountryNames[want.lang] != want.name {
+			t.Errorf("expected only %s name %q, got %v", want.lang, want.name, resolved.CountryNames)
+		}
+	}
+
+	if stats := dbs.defaultDatabase().CacheStats(false); stats.Size != 1 || *stats.Hits != 2 || *stats.Misses != 1 {
+		t.Errorf("expected one cache entry hit twice, got %+v", stats)
+	}
+}
+
+func TestCountryNotFound(t *testing.T) {
+	handler := handleCountry(newTestEditions(t), "", false, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=10.0.0.1&include_continent=true", nil)
+	var resolved map[string]json.RawMessage
+	serveTest(t, handler, req, http.StatusOK, &resolved)
+	if country, ok := resolved["country"]; !ok || string(country) != "null" {
+		t.Errorf("expected country null, got %s", country)
+	}
+	if continent, ok := resolved["continent"]; ok {
+		t.Errorf("expected continent to be left out, got %s", continent)
+	}
+}
+
+func TestCountryLocation(t *testing.T) {
+	handler := handleCountry(newTestCityEditions(t), "", false, "")
+
+	var resolved map[string]json.RawMessage
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=195.50.209.246&edition=GeoLite2-City&include_location=true", nil)
+	serveTest(t, handler, req, http.StatusOK, &resolved)
+	if location, want := resolved["location"], `{"latitude":59.437,"longitude":24.7535,"accuracy_radius":20,"time_zone":null}`; string(location) != want {
+		t.Errorf("expected location %s, got %s", want, location)
+	}
+
+	var message string
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=195.50.209.246&include_location=true", nil)
+	serveTest(t, handler, req, http.StatusBadRequest, &message)
+	if want := `edition "GeoLite2-Country" has no location data, use a City edition`; message != want {
+		t.Errorf("expected %q, got %q", want, message)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geosvc_lookups_total",
+		Help: "Total number of IP lookups.",
+	})
+	metricCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geosvc_cache_hits_total",
+		Help: "Total number of lookups served from the cache.",
+	})
+	metricCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geosvc_cache_misses_total",
+		Help: "Total number of lookups which had to query the database.",
+	})
+	metricLookupErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geosvc_lookup_errors_total",
+		Help: "Total number of lookups which failed.",
+	})
+	metricBulkRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "geosvc_bulk_request_size",
+		Help:    "Number of IPs in bulk requests.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"endpoint"})
+	metricDatabaseBuildEpoch = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "geosvc_database_build_epoch",
+		Help: "Build time of the loaded database as a unix timestamp.",
+	}, []string{"edition"})
+)
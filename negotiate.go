@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// lookupCSVHeader is the header row of CSV lookup responses
+var lookupCSVHeader = []string{"ip", "country", "city", "latitude", "longitude"}
+
+// lookupCSVRow turns a lookup result into a CSV row matching lookupCSVHeader,
+// with the city name in the first of langs the database has it in. Unknown
+// values are left empty.
+func lookupCSVRow(ip string, record *GeoIPRecord, langs []string) []string {
+	city, _ := preferredName(record.City.Names, langs)
+	row := []string{ip, "", city, "", ""}
+	if record.Country.ISOCode != nil {
+		row[1] = *record.Country.ISOCode
+	}
+	if record.Location.Latitude != nil {
+		row[3] = strconv.FormatFloat(*record.Location.Latitude, 'f', -1, 64)
+	}
+	if record.Location.Longitude != nil {
+		row[4] = strconv.FormatFloat(*record.Location.Longitude, 'f', -1, 64)
+	}
+	return row
+}
+
+// wantsCSV tells whether the client asked for CSV rather than JSON. Each is
+// weighed by the q-value of the most specific media range in the Accept
+// header matching it, and CSV has to be preferred over JSON. On a tie,
+// including without an Accept header, JSON wins.
+func wantsCSV(r *http.Request) bool {
+	return acceptQuality(r, "text/csv") > acceptQuality(r, "application/json")
+}
+
+// acceptQuality returns the q-value the Accept header gives mediaType, 0
+// if it's not accepted at all. Exact matches take precedence over type/*,
+// which takes precedence over */*.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, 0
+	for _, accepted := range strings.Split(strings.Join(r.Header.Values("Accept"), ","), ",") {
+		acceptedType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		matchSpecificity := 0
+		switch acceptedType {
+		case mediaType:
+			matchSpecificity = 3
+		case typ + "/*":
+			matchSpecificity = 2
+		case "*/*":
+			matchSpecificity = 1
+		}
+		if matchSpecificity <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if rawQ, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(rawQ, 64); err == nil && v >= 0 && v <= 1 {
+				q = v
+			}
+		}
+		quality, specificity = q, matchSpecificity
+	}
+	return quality
+}
+
+// writeNegotiatedResponse writes a successful response either as CSV made
+// of header and rows, or as JSON made of data, depending on what the client
+// asked for. Errors are always written with writeResponse.
+func writeNegotiatedResponse(w http.ResponseWriter, r *http.Request, httpStatus int, data interface{}, header []string, rows [][]string) {
+	w.Header().Add("Vary", "Accept")
+	if !wantsCSV(r) {
+		writeResponse(w, httpStatus, StatusOK, data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(httpStatus)
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	_ = cw.WriteAll(rows)
+}
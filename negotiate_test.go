@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsCSV(t *testing.T) {
+	tests := []struct {
+		accept string
+		csv    bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/csv", true},
+		{"application/json", false},
+		{"text/csv, application/json", false},
+		{"application/json;q=0.5, text/csv", true},
+		{"text/csv;q=0.5, application/json;q=0.9", false},
+		{"text/csv;q=0.9, application/json;q=0.5", true},
+		{"text/*, */*;q=0.1", true},
+		{"text/csv;q=0, */*", false},
+		{"application/*;q=0.2, text/csv;q=0.3", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/country", nil)
+		if len(test.accept) > 0 {
+			req.Header.Set("Accept", test.accept)
+		}
+		if csv := wantsCSV(req); csv != test.csv {
+			t.Errorf("Accept %q: expected CSV %v, got %v", test.accept, test.csv, csv)
+		}
+	}
+}
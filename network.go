@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+type subnetAddresses struct {
+	Network   resolvedIP `json:"network"`
+	Gateway   resolvedIP `json:"gateway"`
+	Broadcast resolvedIP `json:"broadcast"`
+}
+
+type subnetResult struct {
+	Network   string          `json:"network"`
+	Addresses subnetAddresses `json:"addresses"`
+	Diverges  bool            `json:"diverges"`
+}
+
+// parseRequestNetwork reads the CIDR either from the network query parameter
+// or from the request body, and responds with an error if that fails.
+func parseRequestNetwork(w http.ResponseWriter, r *http.Request, strictJSON bool) (netip.Prefix, bool) {
+	rawNetwork := r.URL.Query().Get("network")
+	if r.Method == http.MethodPost {
+		var networkRequest struct {
+			Network string `json:"network"`
+		}
+		body := http.MaxBytesReader(w, r.Body, 2048)
+		decoder := json.NewDecoder(body)
+		if strictJSON {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(&networkRequest); err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return netip.Prefix{}, false
+		}
+		rawNetwork = networkRequest.Network
+	}
+
+	prefix, err := netip.ParsePrefix(rawNetwork)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse network")
+		return netip.Prefix{}, false
+	}
+	return prefix.Masked(), true
+}
+
+// lookupNetworkAddress resolves a single address along with the network of
+// the database it falls into, and responds with an error if that fails.
+func lookupNetworkAddress(w http.ResponseWriter, db *GeoIPDatabase, addr netip.Addr) (resolvedIP, bool) {
+	ip := net.IP(addr.AsSlice())
+	record, matched, err := db.GetRecordNetwork(ip)
+	if errors.Is(err, ErrorIPv6NotSupported) {
+		writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+		return resolvedIP{}, false
+	} else if err != nil {
+		writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+		return resolvedIP{}, false
+	}
+
+	matchedNetwork := matched.String()
+	return resolvedIP{
+		IP:      ip.String(),
+		Country: record.Country.ISOCode,
+		Network: &matchedNetwork,
+	}, true
+}
+
+// handleNetwork resolves the first address of a CIDR, and tells which
+// network of the database the result actually applies to.
+func handleNetwork(dbs *editionDatabases, strictJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		prefix, ok := parseRequestNetwork(w, r, strictJSON)
+		if !ok {
+			return
+		}
+
+		resolved, ok := lookupNetworkAddress(w, db, prefix.Addr())
+		if !ok {
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, resolved)
+	}
+}
+
+// handleSubnet resolves the network, gateway (first usable) and broadcast
+// addresses of a CIDR, and flags when they fall into different networks of
+// the database.
+func handleSubnet(dbs *editionDatabases, strictJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		prefix, ok := parseRequestNetwork(w, r, strictJSON)
+		if !ok {
+			return
+		}
+
+		// Single address networks (/32, /128) have nothing past the network address
+		networkAddr := prefix.Addr()
+		broadcastAddr := lastAddr(prefix)
+		gatewayAddr := networkAddr
+		if networkAddr != broadcastAddr {
+			gatewayAddr = networkAddr.Next()
+		}
+
+		var addresses subnetAddresses
+		for _, a := range []struct {
+			addr   netip.Addr
+			target *resolvedIP
+		}{
+			{networkAddr, &addresses.Network},
+			{gatewayAddr, &addresses.Gateway},
+			{broadcastAddr, &addresses.Broadcast},
+		} {
+			if *a.target, ok = lookupNetworkAddress(w, db, a.addr); !ok {
+				return
+			}
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, subnetResult{
+			Network:   prefix.String(),
+			Addresses: addresses,
+			Diverges: *addresses.Network.Network != *addresses.Gateway.Network ||
+				*addresses.Network.Network != *addresses.Broadcast.Network,
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+)
+
+type rangeResult struct {
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	Countries []string `json:"countries"`
+	Truncated bool     `json:"truncated"`
+}
+
+// rangeToPrefixes splits the inclusive range from start to end into the
+// smallest set of prefixes covering it exactly. Both addresses must be of
+// the same family, and start must not be after end.
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		// Largest block starting at start which doesn't go past end
+		var prefix netip.Prefix
+		for bits := 0; bits <= start.BitLen(); bits++ {
+			prefix = netip.PrefixFrom(start, bits).Masked()
+			if prefix.Addr() == start && lastAddr(prefix).Compare(end) <= 0 {
+				break
+			}
+		}
+		prefixes = append(prefixes, prefix)
+
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr returns the last address of the prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		for i := prefix.Bits(); i < 32; i++ {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+		return netip.AddrFrom4(b)
+	}
+	b := addr.As16()
+	for i := prefix.Bits(); i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom16(b)
+}
+
+// handleRange resolves the distinct countries of all networks within an
+// inclusive start-end IP range.
+func handleRange(dbs *editionDatabases, strictJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var rangeRequest struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+		}
+		body := http.MaxBytesReader(w, r.Body, 2048)
+		decoder := json.NewDecoder(body)
+		if strictJSON {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(&rangeRequest); err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		}
+
+		start, err := netip.ParseAddr(rangeRequest.Start)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse start ip")
+			return
+		}
+		end, err := netip.ParseAddr(rangeRequest.End)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, "failed to parse end ip")
+			return
+		}
+		start, end = start.Unmap().WithZone(""), end.Unmap().WithZone("")
+		if start.Is4() != end.Is4() {
+			writeResponse(w, http.StatusBadRequest, StatusError, "start and end ip must be of the same address family")
+			return
+		} else if start.Compare(end) > 0 {
+			writeResponse(w, http.StatusBadRequest, StatusError, "start ip must not be after end ip")
+			return
+		}
+
+		countries, truncated, err := db.CountriesWithin(rangeToPrefixes(start, end))
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, rangeResult{
+			Start:     start.String(),
+			End:       end.String(),
+			Countries: countries,
+			Truncated: truncated,
+		})
+	}
+}
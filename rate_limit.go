@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxRateLimitedClients bounds how many clients are tracked at once. The
+	// least recently seen one is forgotten to make room for new ones.
+	maxRateLimitedClients = 1 << 16
+	// rateLimiterIdleTimeout is how long a client has to be gone for its
+	// limiter to be forgotten
+	rateLimiterIdleTimeout = 10 * time.Minute
+)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// Clients by how recently they were seen, of *clientLimiter
+	clients *simplelru.LRU
+	mtx     sync.Mutex
+}
+
+func newRateLimiter(limit rate.Limit, burst int) *rateLimiter {
+	// Only fails with a non-positive size
+	clients, _ := simplelru.NewLRU(maxRateLimitedClients, nil)
+	return &rateLimiter{
+		limit:   limit,
+		burst:   burst,
+		clients: clients,
+	}
+}
+
+// allow takes a token from the client's bucket. When there's none left,
+// returns how long the client should wait before trying again.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := time.Now()
+	var c *clientLimiter
+	if value, ok := l.clients.Get(client); ok {
+		c = value.(*clientLimiter)
+	} else {
+		// Makes room by forgetting the least recently seen client
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients.Add(client, c)
+	}
+	c.lastSeen = now
+
+	reservation := c.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// evictIdle periodically forgets clients which haven't been seen for
+// rateLimiterIdleTimeout. Their buckets would have been full again anyway.
+func (l *rateLimiter) evictIdle() {
+	ticker := time.NewTicker(rateLimiterIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.removeIdle(time.Now())
+	}
+}
+
+// removeIdle forgets clients which haven't been seen for
+// rateLimiterIdleTimeout as of now, starting from the least recently seen
+func (l *rateLimiter) removeIdle(now time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for {
+		_, value, ok := l.clients.GetOldest()
+		if !ok || now.Sub(value.(*clientLimiter).lastSeen) < rateLimiterIdleTimeout {
+			return
+		}
+		l.clients.RemoveOldest()
+	}
+}
+
+// rateLimit rate limits requests to the /api/v1/ endpoints per client IP,
+// which is determined the same way as for /api/v1/self. That's never a hop
+// clients can forge in X-Forwarded-For, as otherwise they could pick a new
+// bucket for every request. Nothing is limited
+// when limiter is nil.
+func rateLimit(limiter *rateLimiter, trustedProxies []netip.Prefix, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := r.RemoteAddr
+		if ip := clientIP(r, trustedProxies); ip != nil {
+			client = ip.String()
+		}
+		if ok, retryAfter := limiter.allow(client); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeResponse(w, http.StatusTooManyRequests, StatusError, "rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Clients behind a trusted proxy can't get a fresh bucket by forging
+// X-Forwarded-For hops
+func TestRateLimitForgedForwardedFor(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	handler := rateLimit(newRateLimiter(rate.Every(time.Hour), 1), trustedProxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, wantStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/self", nil)
+		req.RemoteAddr = "10.0.0.1:41234"
+		req.Header.Set("X-Forwarded-For", "6.6.6."+strconv.Itoa(i)+", 1.2.3.4")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != wantStatus {
+			t.Errorf("request %d: expected status %d, got %d", i, wantStatus, rec.Code)
+		}
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	limiter := newRateLimiter(rate.Every(time.Hour), 1)
+	for i := 0; i <= maxRateLimitedClients; i++ {
+		limiter.allow(strconv.Itoa(i))
+	}
+	if limiter.clients.Len() != maxRateLimitedClients || limiter.clients.Contains("0") {
+		t.Fatal("expected the least recently seen client to be forgotten")
+	}
+
+	limiter.removeIdle(time.Now().Add(rateLimiterIdleTimeout / 2))
+	if limiter.clients.Len() != maxRateLimitedClients {
+		t.Fatal("expected no client to be idle yet")
+	}
+	limiter.removeIdle(time.Now().Add(rateLimiterIdleTimeout))
+	if limiter.clients.Len() != 0 {
+		t.Fatalf("expected every client to be idle, %d left", limiter.clients.Len())
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// serveWhenSetUp answers everything but the probes and metrics with 503 until
+// the databases have been set up for the first time, as the server is already
+// listening while they're being downloaded.
+func serveWhenSetUp(setUp *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+		default:
+			if !setUp.Load() {
+				w.Header().Set("Content-Type", "application/json")
+				writeResponse(w, http.StatusServiceUnavailable, StatusError, "database not loaded")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeWhenSetUp(t *testing.T) {
+	var setUp atomic.Bool
+	handler := serveWhenSetUp(&setUp, handleCountry(newTestEditions(t), "", false, ""))
+
+	var message string
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4", nil)
+	serveTest(t, handler, req, http.StatusServiceUnavailable, &message)
+	if message != "database not loaded" {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	setUp.Store(true)
+	var response struct {
+		Country string `json:"country"`
+	}
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/country?ip=1.2.3.4", nil)
+	serveTest(t, handler, req, http.StatusOK, &response)
+	if response.Country != "DE" {
+		t.Errorf("expected DE, got %q", response.Country)
+	}
+}
+
+func TestReadyDuringUpdate(t *testing.T) {
+	db := newTestDatabase(t)
+
+	// As held for the whole database update
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if !db.Ready() {
+		t.Error("expected database to be ready")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma separated list of CIDRs
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, rawPrefix := range strings.Split(value, ",") {
+		rawPrefix = strings.TrimSpace(rawPrefix)
+		if len(rawPrefix) == 0 {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(rawPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", rawPrefix, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// peerAddr parses the address of the connecting peer from
+// http.Request.RemoteAddr, with or without a port
+func peerAddr(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return peer.Unmap().WithZone(""), true
+}
+
+// isTrustedProxy tells whether addr is within trustedProxies
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP determines the IP of the client which made the request. Forwarded
+// headers are only looked at when the direct peer is one of trustedProxies,
+// as anyone else could put anything into them. Likewise, X-Forwarded-For is
+// followed from the right only through trustedProxies: every hop left of the
+// first untrusted one is up to the client.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) net.IP {
+	peer, ok := peerAddr(r.RemoteAddr)
+	if !ok {
+		return nil
+	}
+	if !isTrustedProxy(peer, trustedProxies) {
+		return net.IP(peer.AsSlice())
+	}
+
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+		var client netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// Can't tell who's behind it, the last trusted proxy
+				// is as far as we know
+				break
+			}
+			client = hop.Unmap().WithZone("")
+			if !isTrustedProxy(client, trustedProxies) {
+				break
+			}
+		}
+		if client.IsValid() {
+			return net.IP(client.AsSlice())
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return net.IP(peer.AsSlice())
+}
+
+// handleSelf resolves the IP of the client making the request
+func handleSelf(dbs *editionDatabases, trustedProxies []netip.Prefix) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		ip := clientIP(r, trustedProxies)
+		if ip == nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, "failed to determine client ip")
+			return
+		}
+
+		record, err := db.GetRecord(ip)
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		writeResponse(w, http.StatusOK, StatusOK, resolvedIP{
+			IP:      ip.String(),
+			Country: record.Country.ISOCode,
+		})
+	}
+}
+
+type clientIPDryRun struct {
+	resolvedIP
+	TrustedProxy bool `json:"trusted_proxy"`
+}
+
+// handleClientIPDryRun resolves the client IP the same way as handleSelf,
+// but of a request described in the body instead of the request itself, for
+// checking GEOSVC_TRUSTED_PROXIES.
+func handleClientIPDryRun(dbs *editionDatabases, trustedProxies []netip.Prefix, strictJSON bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodPost {
+			writeResponse(w, http.StatusMethodNotAllowed, StatusError, "method not allowed")
+			return
+		}
+
+		db, ok := dbs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var dryRunRequest struct {
+			RemoteAddr string            `json:"remote_addr"`
+			Headers    map[string]string `json:"headers"`
+		}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		if strictJSON {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(&dryRunRequest); err != nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		}
+
+		described := &http.Request{
+			RemoteAddr: dryRunRequest.RemoteAddr,
+			Header:     make(http.Header, len(dryRunRequest.Headers)),
+		}
+		for name, value := range dryRunRequest.Headers {
+			described.Header.Set(name, value)
+		}
+		ip := clientIP(described, trustedProxies)
+		if ip == nil {
+			writeResponse(w, http.StatusBadRequest, StatusError, "failed to determine client ip")
+			return
+		}
+
+		record, err := db.GetRecord(ip)
+		if errors.Is(err, ErrorIPv6NotSupported) {
+			writeResponse(w, http.StatusBadRequest, StatusError, err.Error())
+			return
+		} else if err != nil {
+			writeResponse(w, http.StatusInternalServerError, StatusError, err.Error())
+			return
+		}
+
+		// clientIP already made sure that it parses
+		peer, _ := peerAddr(dryRunRequest.RemoteAddr)
+		writeResponse(w, http.StatusOK, StatusOK, clientIPDryRun{
+			resolvedIP: resolvedIP{
+				IP:      ip.String(),
+				Country: record.Country.ISOCode,
+			},
+			TrustedProxy: isTrustedProxy(peer, trustedProxies),
+		})
+	}
+}
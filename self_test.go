@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestClientIPDryRun(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	handler := handleClientIPDryRun(newTestEditions(t), trustedProxies, false)
+
+	tests := []struct {
+		name         string
+		body         string
+		ip           string
+		country      string
+		trustedProxy bool
+	}{
+		{"trusted", `{"remote_addr":"10.0.0.1:41234","headers":{"X-Forwarded-For":"1.2.3.4"}}`, "1.2.3.4", "DE", true},
+		{"untrusted", `{"remote_addr":"8.8.8.8:41234","headers":{"X-Forwarded-For":"1.2.3.4"}}`, "8.8.8.8", "US", false},
+		{"no port", `{"remote_addr":"195.50.0.1"}`, "195.50.0.1", "EE", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/client-ip", strings.NewReader(test.body))
+			var dryRun clientIPDryRun
+			serveTest(t, handler, req, http.StatusOK, &dryRun)
+			if dryRun.IP != test.ip || dryRun.Country == nil || *dryRun.Country != test.country {
+				t.Errorf("unexpected result %+v", dryRun)
+			}
+			if dryRun.TrustedProxy != test.trustedProxy {
+				t.Errorf("expected trusted_proxy %v", test.trustedProxy)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/client-ip", nil)
+	var message string
+	serveTest(t, handler, req, http.StatusMethodNotAllowed, &message)
+}
+
+func TestClientIPForwardedFor(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name         string
+		forwardedFor []string
+		realIP       string
+		ip           string
+	}{
+		{"single hop", []string{"1.2.3.4"}, "", "1.2.3.4"},
+		{"forged hops", []string{"6.6.6.6, 1.2.3.4"}, "", "1.2.3.4"},
+		{"trusted hops", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2, 10.0.0.3"}, "", "1.2.3.4"},
+		{"multiple headers", []string{"6.6.6.6", "1.2.3.4, 10.0.0.2"}, "", "1.2.3.4"},
+		{"only trusted hops", []string{"10.0.0.2, 10.0.0.3"}, "", "10.0.0.2"},
+		{"invalid hop", []string{"1.2.3.4, unknown, 10.0.0.2"}, "", "10.0.0.2"},
+		{"nothing usable", []string{"unknown"}, "8.8.8.8", "8.8.8.8"},
+		{"real ip", nil, "8.8.8.8", "8.8.8.8"},
+		{"no headers", nil, "", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/self", nil)
+			req.RemoteAddr = "10.0.0.1:41234"
+			for _, forwardedFor := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			if len(test.realIP) > 0 {
+				req.Header.Set("X-Real-IP", test.realIP)
+			}
+			if ip := clientIP(req, trustedProxies); ip.String() != test.ip {
+				t.Errorf("expected %s, got %s", test.ip, ip)
+			}
+		})
+	}
+
+	// Headers of untrusted peers are ignored
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/self", nil)
+	req.RemoteAddr = "8.8.8.8:41234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if ip := clientIP(req, trustedProxies); ip.String() != "8.8.8.8" {
+		t.Errorf("expected the peer, got %s", ip)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsdMaxPacketSize keeps packets within a single Ethernet frame
+const statsdMaxPacketSize = 1432
+
+// statsdEmitter sends the geosvc_* Prometheus metrics to a statsd server, so
+// that both see the same numbers. Counters are sent as the increase since
+// the last emit, gauges as is. Labels are sent as DogStatsD tags.
+type statsdEmitter struct {
+	conn     net.Conn
+	gatherer prometheus.Gatherer
+
+	// Counter values as of the last emit, keyed by the metric line prefix
+	last    map[string]float64
+	lastMtx sync.Mutex
+}
+
+func newStatsdEmitter(addr string, gatherer prometheus.Gatherer) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdEmitter{
+		conn:     conn,
+		gatherer: gatherer,
+		last:     make(map[string]float64),
+	}, nil
+}
+
+// emit sends the current metric values. Counters which haven't changed
+// since the last emit are left out.
+func (e *statsdEmitter) emit() error {
+	e.lastMtx.Lock()
+	defer e.lastMtx.Unlock()
+
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "geosvc_") {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			tags := statsdTags(metric.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = e.appendCounter(lines, name, tags, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				lines = append(lines, fmt.Sprintf("%s:%s|g%s", name, formatStatsdValue(metric.GetGauge().GetValue()), tags))
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				lines = e.appendCounter(lines, name+"_count", tags, float64(histogram.GetSampleCount()))
+				lines = e.appendCounter(lines, name+"_sum", tags, histogram.GetSampleSum())
+			}
+		}
+	}
+
+	return e.send(lines)
+}
+
+// appendCounter appends the increase of a counter since the last emit
+func (e *statsdEmitter) appendCounter(lines []string, name, tags string, value float64) []string {
+	key := name + tags
+	delta := value - e.last[key]
+	if delta < 0 {
+		// Counters only go back to zero, e.g. on a restart of the process
+		delta = value
+	}
+	e.last[key] = value
+	if delta == 0 {
+		return lines
+	}
+	return append(lines, fmt.Sprintf("%s:%s|c%s", name, formatStatsdValue(delta), tags))
+}
+
+// send packs lines into as few packets as possible
+func (e *statsdEmitter) send(lines []string) error {
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacketSize {
+			if _, err := e.conn.Write([]byte(packet.String())); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := e.conn.Write([]byte(packet.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *statsdEmitter) Close() error {
+	return e.conn.Close()
+}
+
+// formatStatsdValue formats v without an exponent, which not every statsd
+// server understands
+func formatStatsdValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// statsdTags formats labels as DogStatsD tags
+func statsdTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		tags = append(tags, label.GetName()+":"+label.GetValue())
+	}
+	return "|#" + strings.Join(tags, ",")
+}
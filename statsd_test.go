@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsdEmitter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+
+	registry := prometheus.NewRegistry()
+	lookups := prometheus.NewCounter(prometheus.CounterOpts{Name: "geosvc_lookups_total"})
+	buildEpoch := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "geosvc_database_build_epoch"}, []string{"edition"})
+	other := prometheus.NewCounter(prometheus.CounterOpts{Name: "other_total"})
+	registry.MustRegister(lookups, buildEpoch, other)
+
+	statsd, err := newStatsdEmitter(server.LocalAddr().String(), registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = statsd.Close() }()
+
+	receive := func() []string {
+		t.Helper()
+		buf := make([]byte, statsdMaxPacketSize)
+		_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		slices.Sort(lines)
+		return lines
+	}
+
+	lookups.Add(3)
+	other.Inc()
+	buildEpoch.WithLabelValues(CountryDBEdition).Set(1700000000)
+	if err := statsd.emit(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"geosvc_database_build_epoch:1700000000|g|#edition:GeoLite2-Country", "geosvc_lookups_total:3|c"}
+	if lines := receive(); !slices.Equal(lines, want) {
+		t.Errorf("expected %q, got %q", want, lines)
+	}
+
+	// Only the increase is sent, and nothing for counters which didn't move
+	lookups.Add(2)
+	if err := statsd.emit(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"geosvc_database_build_epoch:1700000000|g|#edition:GeoLite2-Country", "geosvc_lookups_total:2|c"}
+	if lines := receive(); !slices.Equal(lines, want) {
+		t.Errorf("expected %q, got %q", want, lines)
+	}
+	if err := statsd.emit(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"geosvc_database_build_epoch:1700000000|g|#edition:GeoLite2-Country"}
+	if lines := receive(); !slices.Equal(lines, want) {
+		t.Errorf("expected %q, got %q", want, lines)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often certificate files are checked for
+// changes at most
+const certificateCheckInterval = 10 * time.Second
+
+// certificateReloader serves the TLS certificate from certPath and keyPath,
+// and reloads it once either of the files has changed. Files are checked on
+// handshakes, so that rotated certificates get picked up without a restart
+// even when the files are replaced through symlinks.
+type certificateReloader struct {
+	certPath string
+	keyPath  string
+
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastChecked time.Time
+	mtx         sync.Mutex
+}
+
+func newCertificateReloader(certPath, keyPath string) (*certificateReloader, error) {
+	c := &certificateReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate from disk. The previous one is kept when
+// that fails.
+func (c *certificateReloader) Reload() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.reload()
+}
+
+// reload is Reload with c.mtx held
+func (c *certificateReloader) reload() error {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	slog.Info("tls certificate loaded", "cert", c.certPath, "key", c.keyPath)
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if time.Since(c.lastChecked) >= certificateCheckInterval {
+		c.lastChecked = time.Now()
+		if c.changed() {
+			if err := c.reload(); err != nil {
+				slog.Error("failed to reload tls certificate, keeping the previous one", "cert", c.certPath, "key", c.keyPath, "error", err)
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+// changed tells whether either of the files looks different from when they
+// were loaded. c.mtx must be held.
+func (c *certificateReloader) changed() bool {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(c.certModTime) || !keyInfo.ModTime().Equal(c.keyModTime)
+}
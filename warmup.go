@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// warmCache looks up every IP listed in the file at warmupPath, one per
+// line, so that they're cached before the first requests for them arrive.
+// Blank lines are skipped, invalid ones are logged and skipped.
+func warmCache(db *GeoIPDatabase, warmupPath string) {
+	f, err := os.Open(warmupPath)
+	if err != nil {
+		slog.Error("failed to open cache warmup file", "path", warmupPath, "error", err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	start := time.Now()
+	warmed := 0
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(line)
+		if ip == nil {
+			slog.Warn("skipping invalid ip in cache warmup file", "path", warmupPath, "line", lineNumber, "value", line)
+			continue
+		}
+		if _, err := db.GetRecord(ip); err != nil {
+			slog.Warn("failed to look up ip from cache warmup file", "path", warmupPath, "line", lineNumber, "ip", ip.String(), "error", err)
+			continue
+		}
+		warmed++
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read cache warmup file", "path", warmupPath, "error", err)
+	}
+
+	slog.Info("warmed up cache", "path", warmupPath, "entries", warmed, "took", time.Since(start).String())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the database file has to stay unchanged before
+// it's reloaded. Copying a file over produces a burst of writes, and it
+// shouldn't be opened halfway through.
+const watchDebounce = 500 * time.Millisecond
+
+// watchDatabaseFile calls reload whenever the file at databasePath is
+// written to or replaced, once it has settled for watchDebounce. The
+// directory is watched instead of the file itself, so that atomic
+// replacements by rename are noticed too.
+func watchDatabaseFile(databasePath string, reload func() error) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	databasePath = filepath.Clean(databasePath)
+	if err := watcher.Add(filepath.Dir(databasePath)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		// Receives once the file has been left alone for a while, nil when
+		// there's nothing to reload
+		var settled <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != databasePath || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+					continue
+				}
+				settled = time.After(watchDebounce)
+			case <-settled:
+				settled = nil
+				slog.Info("database file changed, reloading", "path", databasePath)
+				if err := reload(); err != nil {
+					slog.Error("failed to reload database file", "path", databasePath, "error", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("failed to watch database file", "path", databasePath, "error", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const updateWebhookTimeout = 10 * time.Second
+
+type updateWebhookPayload struct {
+	Edition    string `json:"edition"`
+	BuildEpoch uint   `json:"build_epoch"`
+	Checksum   string `json:"checksum"`
+}
+
+// notifyUpdateWebhook POSTs the payload to the webhook URL in the
+// background. Failures are only logged.
+func notifyUpdateWebhook(url string, payload updateWebhookPayload) {
+	go func() {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			slog.Error("failed to encode update webhook payload", "error", err)
+			return
+		}
+
+		client := &http.Client{Timeout: updateWebhookTimeout}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("failed to call update webhook", "edition", payload.Edition, "error", err)
+			return
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			slog.Error("update webhook responded with an error", "edition", payload.Edition, "status", resp.StatusCode)
+		}
+	}()
+}